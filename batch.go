@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+const (
+	jobOK      = "ok"
+	jobFailed  = "failed"
+	jobSkipped = "skipped"
+)
+
+// batchInput is one file found on the command line. Files found by walking a
+// directory are skipped rather than failed when they turn out not to be blurls.
+type batchInput struct {
+	path    string
+	walked  bool
+	matched bool
+}
+
+type jobResult struct {
+	job    *job
+	status string
+	err    error
+}
+
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func isInputName(name string) bool {
+	if isReportName(name) {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".blurl", ".json":
+		return true
+	}
+	return false
+}
+
+// splitOutput takes the second of two arguments as the output, unless -o was
+// given or the argument is clearly another input. Any other number of
+// arguments are all inputs. A directory after a directory or a pattern could
+// be either, so it is refused rather than guessed.
+func splitOutput(positional []string, output string) ([]string, string, error) {
+	if len(positional) != 2 || output != "" {
+		return positional, output, nil
+	}
+	first, last := positional[0], positional[1]
+	if hasGlobMeta(last) || (fileExists(last) && isInputName(last)) {
+		return positional, output, nil
+	}
+	if isDirExists(last) && (hasGlobMeta(first) || isDirExists(first)) {
+		return nil, "", fmt.Errorf("%s could be another input or the output, use -o to name the output", last)
+	}
+	return positional[:1], last, nil
+}
+
+func expandInputs(args []string) ([]batchInput, error) {
+	var inputs []batchInput
+	for _, arg := range args {
+		if hasGlobMeta(arg) {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern %q: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %q", arg)
+			}
+			for _, m := range matches {
+				if isDirExists(m) || isReportName(m) {
+					continue
+				}
+				inputs = append(inputs, batchInput{path: m, matched: true})
+			}
+			continue
+		}
+
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			inputs = append(inputs, batchInput{path: arg})
+			continue
+		}
+
+		var walked []string
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() && isInputName(path) {
+				walked = append(walked, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(walked)
+		for _, path := range walked {
+			inputs = append(inputs, batchInput{path: path, walked: true})
+		}
+	}
+	return inputs, nil
+}
+
+// jobNames names each job after its input file, numbering repeats.
+func jobNames(inputs []batchInput) []string {
+	names := make([]string, len(inputs))
+	seen := map[string]int{}
+	for i, in := range inputs {
+		base := filepath.Base(in.path)
+		name := sanitizeSuffix(strings.TrimSuffix(base, filepath.Ext(base)))
+		if name == "" {
+			name = "job"
+		}
+		seen[name]++
+		if seen[name] > 1 {
+			name = fmt.Sprintf("%s_%d", name, seen[name])
+		}
+		names[i] = name
+	}
+	return names
+}
+
+func isBLURLFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	head := make([]byte, 16)
+	n, _ := io.ReadFull(f, head)
+	return detectInputKind(head[:n]) != inputUnknown
+}
+
+// runBatch converts every input with at most workers jobs at a time. Each job
+// writes into its own directory below output.
+func runBatch(inputs []batchInput, output string, workers int, opts convertOptions) error {
+	if output == "" {
+		output = "."
+	}
+	if fileExists(output) {
+		return withExit(exitUsage, fmt.Errorf("output %s must be a directory when converting several inputs", output))
+	}
+
+	opts.selector.noPrompt = true
+
+	names := jobNames(inputs)
+	results := make([]jobResult, len(inputs))
+	for i, in := range inputs {
+		results[i].job = &job{
+			name:   names[i],
+			input:  in.path,
+			output: filepath.Join(output, names[i]) + string(os.PathSeparator),
+		}
+	}
+
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				r := &results[i]
+				if (inputs[i].walked || inputs[i].matched) && !isBLURLFile(r.job.input) {
+					r.status = jobSkipped
+					r.err = errors.New("not a blurl")
+					continue
+				}
+
+				log := r.job.ref("").logger()
+				log.Info("starting job", "input", r.job.input)
+
+				r.err = convertFile(r.job, opts)
+				if r.err != nil {
+					r.status = jobFailed
+					log.Error("job failed", "error", r.err)
+					continue
+				}
+				r.status = jobOK
+			}
+		}()
+	}
+	for i := range inputs {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+
+	printSummary(os.Stdout, results)
+	return batchError(results)
+}
+
+func printSummary(w io.Writer, results []jobResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tINPUT\tDETAIL")
+
+	count := map[string]int{}
+	for _, r := range results {
+		detail := r.job.output
+		if r.err != nil {
+			detail = r.err.Error()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.status, r.job.input, detail)
+		count[r.status]++
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "%d jobs: %d succeeded, %d failed, %d skipped\n",
+		len(results), count[jobOK], count[jobFailed], count[jobSkipped])
+}
+
+// batchError is nil when nothing failed, exitPartial when some jobs succeeded,
+// and carries the first failure's exit code when none did. A batch in which
+// every input was skipped did nothing, which is an input error.
+func batchError(results []jobResult) error {
+	var first error
+	failed, succeeded := 0, 0
+	for _, r := range results {
+		switch r.status {
+		case jobOK:
+			succeeded++
+		case jobFailed:
+			failed++
+			if first == nil {
+				first = r.err
+			}
+		}
+	}
+
+	switch {
+	case failed == 0 && succeeded == 0:
+		return withExit(exitInput, fmt.Errorf("none of the %d inputs is a blurl, all were skipped", len(results)))
+	case failed == 0:
+		return nil
+	case succeeded > 0:
+		return withExit(exitPartial, fmt.Errorf("%d of %d jobs failed", failed, failed+succeeded))
+	}
+	return fmt.Errorf("all %d jobs failed: %w", failed, first)
+}
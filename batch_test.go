@@ -0,0 +1,29 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBatchError(t *testing.T) {
+	ok := jobResult{status: jobOK}
+	skipped := jobResult{status: jobSkipped, err: errors.New("not a blurl")}
+	failed := jobResult{status: jobFailed, err: withExit(exitNetwork, errors.New("timeout"))}
+
+	tests := []struct {
+		name    string
+		results []jobResult
+		want    int
+	}{
+		{"all ok", []jobResult{ok, ok}, exitOK},
+		{"ok and skipped", []jobResult{ok, skipped}, exitOK},
+		{"some failed", []jobResult{ok, failed, skipped}, exitPartial},
+		{"all failed", []jobResult{failed, skipped}, exitNetwork},
+		{"all skipped", []jobResult{skipped, skipped}, exitInput},
+	}
+	for _, tt := range tests {
+		if got := exitCode(batchError(tt.results)); got != tt.want {
+			t.Errorf("%s: exit code %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
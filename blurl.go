@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"bytes"
 	"compress/zlib"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Playlist struct {
@@ -20,6 +22,17 @@ type Playlist struct {
 	URL      string  `json:"url"`
 }
 
+// Playlist types. Previews are short unencrypted clips of a song, served as a
+// single ..._dashinit.mp4 file.
+const (
+	playlistMain    = "main"
+	playlistPreview = "preview"
+)
+
+func (p Playlist) isPreview() bool {
+	return strings.EqualFold(p.Type, playlistPreview)
+}
+
 type BLURL struct {
 	AudioOnly bool       `json:"audioonly"`
 	Ev        string     `json:"ev"`
@@ -56,16 +69,16 @@ func GetMediaURL(blurl *BLURL) string {
 		input := scanner.Text()
 		choice, err := strconv.Atoi(input)
 		if err != nil {
-			fmt.Println("Invalid input, please enter a number")
+			slog.Error("invalid input, please enter a number", "input", input)
 			return ""
 		}
 		if choice < 1 || choice > len(blurl.Playlists) {
-			fmt.Println("Selected number is out of range")
+			slog.Error("selected number is out of range", "choice", choice, "playlists", len(blurl.Playlists))
 			return ""
 		}
 		return blurl.Playlists[choice-1].URL
 	} else {
-		fmt.Println("Failed to read input")
+		slog.Error("failed to read input", "error", scanner.Err())
 		return ""
 	}
 }
@@ -79,7 +92,7 @@ func parseBLURLFromJSON(inblurl *BLURL, filepath string) error {
 
 	err = json.NewDecoder(file).Decode(&inblurl)
 	if err != nil {
-		log.Fatalf("Error decoding JSON: %v", err)
+		return fmt.Errorf("error decoding JSON: %v", err)
 	}
 
 	return nil
@@ -109,3 +122,86 @@ func parseBLURL(inblurl *BLURL, filepath string) error {
 
 	return nil
 }
+
+const (
+	inputUnknown = iota
+	inputBLURL
+	inputJSON
+)
+
+const blurlHeaderSize = 8
+
+var blurlMagic = []byte("blul")
+
+func detectInputKind(head []byte) int {
+	trimmed := bytes.TrimLeft(head, " \t\r\n\xef\xbb\xbf")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return inputJSON
+	}
+
+	if len(head) >= blurlHeaderSize+2 {
+		cmf, flg := head[blurlHeaderSize], head[blurlHeaderSize+1]
+		if cmf&0x0f == 8 && (uint16(cmf)<<8|uint16(flg))%31 == 0 {
+			return inputBLURL
+		}
+	}
+
+	return inputUnknown
+}
+
+func loadBLURL(filepath string) (*BLURL, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 64)
+	n, _ := io.ReadFull(file, head)
+	file.Close()
+
+	var blurl BLURL
+
+	switch detectInputKind(head[:n]) {
+	case inputBLURL:
+		err = parseBLURL(&blurl, filepath)
+	case inputJSON:
+		err = parseBLURLFromJSON(&blurl, filepath)
+	default:
+		return nil, fmt.Errorf("%s is neither a blurl nor a blurl JSON file", filepath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Some blurls only say that they are a preview at the top level.
+	if strings.EqualFold(blurl.Type, playlistPreview) {
+		for i := range blurl.Playlists {
+			if blurl.Playlists[i].Type == "" {
+				blurl.Playlists[i].Type = playlistPreview
+			}
+		}
+	}
+
+	return &blurl, nil
+}
+
+func packBLURL(w io.Writer, jsonData []byte) error {
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(jsonData); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	header := make([]byte, blurlHeaderSize)
+	copy(header, blurlMagic)
+	binary.BigEndian.PutUint32(header[4:], uint32(len(jsonData)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(compressed.Bytes())
+	return err
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 )
 
@@ -58,14 +59,19 @@ func ParseEV(b []byte) (Envelope, error) {
 	return data, nil
 }
 
-func GetEncryptionKey(filePath, nonce string, encryptedkey []byte) []byte {
+// FindRecord returns the offset of the keystore record whose check byte
+// matches nonce, or -1 when there is none.
+func FindRecord(filePath, nonce string) (int64, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		fmt.Println("Error opening file:", err)
-		return nil
+		return -1, err
 	}
 	defer file.Close()
 
+	return findRecord(file, nonce)
+}
+
+func findRecord(file io.ReadSeeker, nonce string) (int64, error) {
 	offset := int64(0)
 	for {
 
@@ -73,14 +79,13 @@ func GetEncryptionKey(filePath, nonce string, encryptedkey []byte) []byte {
 
 		var first5Bytes [5]byte
 
-		_, err = file.Read(first5Bytes[:])
+		_, err := io.ReadFull(file, first5Bytes[:])
 
-		if err == io.EOF {
-			break
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return -1, nil
 		}
 		if err != nil {
-			fmt.Println("Error reading file:", err)
-			break
+			return -1, err
 		}
 
 		hash := md5.New()
@@ -89,26 +94,45 @@ func GetEncryptionKey(filePath, nonce string, encryptedkey []byte) []byte {
 		result := hash.Sum(nil)
 
 		if result[0] == first5Bytes[4] {
-			// Getting the encryption key for the encryption key after we find the right key
-			file.Seek(15, io.SeekCurrent)
+			return offset, nil
+		}
 
-			var EncryptionKey [32]byte
-			_, err = file.Read(EncryptionKey[:])
-			if err != nil && err != io.EOF {
-				fmt.Println("Error Getting Encryption Key:", err)
-				break
-			}
+		offset += 0x34
+	}
+}
 
-			encryptionkey, err := AesDecrypt(EncryptionKey[:], encryptedkey)
+func GetEncryptionKey(filePath, nonce string, encryptedkey []byte) []byte {
+	file, err := os.Open(filePath)
+	if err != nil {
+		slog.Error("error opening keystore", "path", filePath, "error", err)
+		return nil
+	}
+	defer file.Close()
 
-			if err != nil {
-				fmt.Println("failed to decrypt encryption key:", err)
-			}
+	offset, err := findRecord(file, nonce)
+	if err != nil {
+		slog.Error("error reading keystore", "path", filePath, "error", err)
+		return nil
+	}
+	if offset < 0 {
+		return nil
+	}
 
-			return encryptionkey
-		}
+	// Getting the encryption key for the encryption key after we find the right key
+	file.Seek(offset+5+15, io.SeekStart)
 
-		offset += 0x34
+	var EncryptionKey [32]byte
+	_, err = file.Read(EncryptionKey[:])
+	if err != nil && err != io.EOF {
+		slog.Error("error reading keystore record", "path", filePath, "offset", offset, "error", err)
+		return nil
+	}
+
+	encryptionkey, err := AesDecrypt(EncryptionKey[:], encryptedkey)
+
+	if err != nil {
+		slog.Error("failed to decrypt encryption key", "error", err)
 	}
-	return nil
+
+	return encryptionkey
 }
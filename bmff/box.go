@@ -0,0 +1,225 @@
+// Package bmff reads and writes ISO base media files (ISO/IEC 14496-12), the
+// container format of MP4 and of DASH segments.
+package bmff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Box is one box of a file. Payload is everything after the header. Boxes
+// that hold other boxes have them parsed into Children.
+type Box struct {
+	Type       string
+	UserType   [16]byte
+	Offset     int64
+	Size       int64
+	HeaderSize int
+	Payload    []byte
+	Children   []Box
+}
+
+// containers are the boxes whose payload is nothing but other boxes.
+var containers = map[string]bool{
+	"moov": true, "trak": true, "edts": true, "mdia": true, "minf": true,
+	"dinf": true, "stbl": true, "mvex": true, "moof": true, "traf": true,
+	"mfra": true, "udta": true, "sinf": true, "schi": true, "tref": true,
+}
+
+// Parse reads every box of buf, descending into containers. Offsets count
+// from the start of buf. On error it returns the boxes read so far.
+func Parse(buf []byte) ([]Box, error) {
+	return parse(buf, 0)
+}
+
+func parse(buf []byte, base int64) ([]Box, error) {
+	var boxes []Box
+	for off := 0; off < len(buf); {
+		b, err := parseBox(buf[off:], base+int64(off))
+		if err != nil {
+			return boxes, err
+		}
+		boxes = append(boxes, b)
+		off += int(b.Size)
+	}
+	return boxes, nil
+}
+
+func parseBox(buf []byte, offset int64) (Box, error) {
+	h, err := parseHeader(buf, offset)
+	if err != nil {
+		return Box{}, err
+	}
+	if h.Size == 0 {
+		h.Size = int64(len(buf))
+	}
+	if h.Size < int64(h.HeaderSize) || h.Size > int64(len(buf)) {
+		return Box{}, fmt.Errorf("invalid %s box size %d at offset %d", h.Type, h.Size, offset)
+	}
+
+	b := Box{
+		Type:       h.Type,
+		UserType:   h.UserType,
+		Offset:     offset,
+		Size:       h.Size,
+		HeaderSize: h.HeaderSize,
+		Payload:    buf[h.HeaderSize:h.Size],
+	}
+
+	switch {
+	case containers[b.Type]:
+		b.Children, err = parse(b.Payload, offset+int64(h.HeaderSize))
+	case b.Type == "stsd" && len(b.Payload) >= 8:
+		// A full box with an entry count, then one sample entry per entry.
+		b.Children, err = parse(b.Payload[8:], offset+int64(h.HeaderSize)+8)
+	}
+	if err != nil {
+		return b, fmt.Errorf("%s: %v", b.Type, err)
+	}
+	return b, nil
+}
+
+// Header is the size and type of a box.
+type Header struct {
+	Type     string
+	UserType [16]byte
+	Offset   int64
+	// Size is the size of the whole box, or 0 when it runs to the end of the
+	// file.
+	Size       int64
+	HeaderSize int
+}
+
+func parseHeader(buf []byte, offset int64) (Header, error) {
+	if len(buf) < 8 {
+		return Header{}, fmt.Errorf("truncated box header at offset %d", offset)
+	}
+	h := Header{
+		Type:       string(buf[4:8]),
+		Offset:     offset,
+		Size:       int64(binary.BigEndian.Uint32(buf[0:4])),
+		HeaderSize: 8,
+	}
+	if h.Size == 1 {
+		if len(buf) < 16 {
+			return Header{}, fmt.Errorf("truncated large size %s box at offset %d", h.Type, offset)
+		}
+		size := binary.BigEndian.Uint64(buf[8:16])
+		if size > math.MaxInt64 {
+			return Header{}, fmt.Errorf("invalid %s box size %d at offset %d", h.Type, size, offset)
+		}
+		h.Size = int64(size)
+		h.HeaderSize = 16
+	}
+	if h.Type == "uuid" {
+		if len(buf) < h.HeaderSize+16 {
+			return Header{}, fmt.Errorf("truncated uuid box at offset %d", offset)
+		}
+		copy(h.UserType[:], buf[h.HeaderSize:])
+		h.HeaderSize += 16
+	}
+	return h, nil
+}
+
+// Find returns the first box matching path, such as "moov", "trak", "tkhd",
+// descending through children.
+func Find(boxes []Box, path ...string) (Box, bool) {
+	for _, b := range boxes {
+		if b.Type != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return b, true
+		}
+		if child, ok := Find(b.Children, path[1:]...); ok {
+			return child, true
+		}
+	}
+	return Box{}, false
+}
+
+// FindAll returns every box matching path.
+func FindAll(boxes []Box, path ...string) []Box {
+	var found []Box
+	for _, b := range boxes {
+		if b.Type != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			found = append(found, b)
+		} else {
+			found = append(found, FindAll(b.Children, path[1:]...)...)
+		}
+	}
+	return found
+}
+
+// Find returns the first box below b matching path.
+func (b Box) Find(path ...string) (Box, bool) {
+	return Find(b.Children, path...)
+}
+
+// Bytes serialises the box. Boxes with children are rebuilt from them, so
+// changes to the children are kept.
+func (b Box) Bytes() []byte {
+	payload := b.Payload
+	if b.Children != nil {
+		var p []byte
+		if b.Type == "stsd" {
+			p = append(p, b.Payload[:4]...)
+			p = binary.BigEndian.AppendUint32(p, uint32(len(b.Children)))
+		}
+		for _, c := range b.Children {
+			p = append(p, c.Bytes()...)
+		}
+		payload = p
+	}
+	if b.Type == "uuid" {
+		return Encode(b.Type, b.UserType[:], payload)
+	}
+	return Encode(b.Type, payload)
+}
+
+// Encode serialises a box from its type and payload, which may be given in
+// parts.
+func Encode(typ string, payload ...[]byte) []byte {
+	var size int64 = 8
+	for _, p := range payload {
+		size += int64(len(p))
+	}
+	b := make([]byte, 0, size+8)
+	b = appendHeader(b, typ, size)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// EncodeFull serialises a full box, whose payload starts with a version and
+// flags.
+func EncodeFull(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	header := binary.BigEndian.AppendUint32(nil, uint32(version)<<24|flags&0xffffff)
+	return Encode(typ, append([][]byte{header}, payload...)...)
+}
+
+// appendHeader writes a box header for a box of size bytes with an 8-byte
+// header, switching to a large size when needed.
+func appendHeader(b []byte, typ string, size int64) []byte {
+	if size > math.MaxUint32 {
+		b = binary.BigEndian.AppendUint32(b, 1)
+		b = append(b, typ...)
+		return binary.BigEndian.AppendUint64(b, uint64(size+8))
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	return append(b, typ...)
+}
+
+// fullHeader reads the version and flags of a full box.
+func fullHeader(b Box) (uint8, uint32, error) {
+	if len(b.Payload) < 4 {
+		return 0, 0, fmt.Errorf("truncated %s box", b.Type)
+	}
+	v := binary.BigEndian.Uint32(b.Payload[0:4])
+	return uint8(v >> 24), v & 0xffffff, nil
+}
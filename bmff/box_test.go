@@ -0,0 +1,66 @@
+package bmff
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// parseOne parses buf, which must hold exactly one box.
+func parseOne(t *testing.T, buf []byte) Box {
+	t.Helper()
+	boxes, err := Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(boxes) != 1 {
+		t.Fatalf("parsed %d boxes, want 1", len(boxes))
+	}
+	return boxes[0]
+}
+
+// roundTrip parses buf with parse and checks that encode writes it back byte
+// for byte.
+func roundTrip[T any](t *testing.T, buf []byte, parse func(Box) (*T, error), encode func(*T) []byte) *T {
+	t.Helper()
+	v, err := parse(parseOne(t, buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := encode(v); !bytes.Equal(got, buf) {
+		t.Fatalf("round trip changed the box:\n got %s\nwant %s", hex.EncodeToString(got), hex.EncodeToString(buf))
+	}
+	return v
+}
+
+func TestBoxBytesRoundTrip(t *testing.T) {
+	stsd := EncodeFull("stsd", 0, 0, []byte{0, 0, 0, 1}, Encode("mp4a", make([]byte, 28), Encode("esds", []byte{1, 2, 3})))
+	moov := Encode("moov",
+		EncodeFull("mvhd", 0, 0, make([]byte, 96)),
+		Encode("trak",
+			EncodeFull("tkhd", 0, 3, make([]byte, 80)),
+			Encode("mdia", Encode("minf", Encode("stbl", stsd)))),
+		Encode("uuid", bytes.Repeat([]byte{0xab}, 16), []byte("payload")))
+
+	b := parseOne(t, moov)
+	if _, ok := b.Find("trak", "mdia", "minf", "stbl", "stsd", "mp4a"); !ok {
+		t.Fatal("sample entry not found below stsd")
+	}
+	if got := b.Bytes(); !bytes.Equal(got, moov) {
+		t.Fatalf("round trip changed the box:\n got %s\nwant %s", hex.EncodeToString(got), hex.EncodeToString(moov))
+	}
+}
+
+func TestParseLargeSize(t *testing.T) {
+	buf := []byte{0, 0, 0, 1, 'f', 'r', 'e', 'e', 0, 0, 0, 0, 0, 0, 0, 20, 1, 2, 3, 4}
+	b := parseOne(t, buf)
+	if b.HeaderSize != 16 || !bytes.Equal(b.Payload, []byte{1, 2, 3, 4}) {
+		t.Fatalf("got header size %d and payload %v", b.HeaderSize, b.Payload)
+	}
+}
+
+func TestParseInvalidSize(t *testing.T) {
+	if _, err := Parse([]byte{0, 0, 0, 64, 'f', 'r', 'e', 'e'}); err == nil {
+		t.Fatal("box larger than the buffer was accepted")
+	}
+}
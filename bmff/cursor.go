@@ -0,0 +1,64 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// cursor reads the fields of a payload in order. The first read past the end
+// sets err and every read after it returns zero.
+type cursor struct {
+	p   []byte
+	pos int
+	typ string
+	err error
+}
+
+func newCursor(b Box) *cursor {
+	return &cursor{p: b.Payload, typ: b.Type}
+}
+
+func (c *cursor) take(n int) []byte {
+	if c.err != nil {
+		return make([]byte, n)
+	}
+	if n < 0 || c.pos+n > len(c.p) {
+		c.err = fmt.Errorf("truncated %s box", c.typ)
+		return make([]byte, max(n, 0))
+	}
+	b := c.p[c.pos : c.pos+n]
+	c.pos += n
+	return b
+}
+
+func (c *cursor) u8() uint8   { return c.take(1)[0] }
+func (c *cursor) u16() uint16 { return binary.BigEndian.Uint16(c.take(2)) }
+func (c *cursor) u32() uint32 { return binary.BigEndian.Uint32(c.take(4)) }
+func (c *cursor) u64() uint64 { return binary.BigEndian.Uint64(c.take(8)) }
+
+// uint reads a field that is 4 bytes in version 0 boxes and 8 in version 1.
+func (c *cursor) uint(version uint8) uint64 {
+	if version == 1 {
+		return c.u64()
+	}
+	return uint64(c.u32())
+}
+
+func (c *cursor) kid() [16]byte {
+	var k [16]byte
+	copy(k[:], c.take(16))
+	return k
+}
+
+func (c *cursor) rest() []byte {
+	return c.take(len(c.p) - c.pos)
+}
+
+// appendUint appends a field that is 4 bytes in version 0 boxes and 8 in
+// version 1.
+func appendUint(b []byte, version uint8, v uint64) []byte {
+	if version == 1 {
+		return binary.BigEndian.AppendUint64(b, v)
+	}
+	return binary.BigEndian.AppendUint32(b, uint32(v))
+}
@@ -0,0 +1,383 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// tfhd flags.
+const (
+	TfhdBaseDataOffset         = 0x000001
+	TfhdSampleDescriptionIndex = 0x000002
+	TfhdDefaultSampleDuration  = 0x000008
+	TfhdDefaultSampleSize      = 0x000010
+	TfhdDefaultSampleFlags     = 0x000020
+	TfhdDurationIsEmpty        = 0x010000
+	TfhdDefaultBaseIsMoof      = 0x020000
+)
+
+// trun flags.
+const (
+	TrunDataOffset            = 0x000001
+	TrunFirstSampleFlags      = 0x000004
+	TrunSampleDuration        = 0x000100
+	TrunSampleSize            = 0x000200
+	TrunSampleFlags           = 0x000400
+	TrunSampleCompositionTime = 0x000800
+)
+
+// Moof is a movie fragment.
+type Moof struct {
+	Sequence uint32
+	Trafs    []Traf
+	Box      Box
+}
+
+// Traf is the part of a fragment that belongs to one track. The senc box is
+// kept as a Box, because reading it needs the IV size from the track's tenc.
+type Traf struct {
+	Tfhd  Tfhd
+	Tfdt  *Tfdt
+	Truns []Trun
+	Senc  *Box
+}
+
+func ParseMoof(b Box) (*Moof, error) {
+	m := &Moof{Box: b}
+	if mfhd, ok := b.Find("mfhd"); ok {
+		c := newCursor(mfhd)
+		c.u32()
+		m.Sequence = c.u32()
+		if c.err != nil {
+			return nil, c.err
+		}
+	}
+
+	for _, child := range b.Children {
+		if child.Type != "traf" {
+			continue
+		}
+		t, err := ParseTraf(child)
+		if err != nil {
+			return nil, err
+		}
+		m.Trafs = append(m.Trafs, *t)
+	}
+	return m, nil
+}
+
+func ParseTraf(b Box) (*Traf, error) {
+	t := &Traf{}
+	tfhd, ok := b.Find("tfhd")
+	if !ok {
+		return nil, fmt.Errorf("traf has no tfhd box")
+	}
+	h, err := ParseTfhd(tfhd)
+	if err != nil {
+		return nil, err
+	}
+	t.Tfhd = *h
+
+	for _, child := range b.Children {
+		switch child.Type {
+		case "tfdt":
+			if t.Tfdt, err = ParseTfdt(child); err != nil {
+				return nil, err
+			}
+		case "trun":
+			r, err := ParseTrun(child)
+			if err != nil {
+				return nil, err
+			}
+			t.Truns = append(t.Truns, *r)
+		case "senc":
+			senc := child
+			t.Senc = &senc
+		}
+	}
+	return t, nil
+}
+
+// Tfhd is the track fragment header. Optional fields are only meaningful
+// when their flag is set.
+type Tfhd struct {
+	Flags                  uint32
+	TrackID                uint32
+	BaseDataOffset         uint64
+	SampleDescriptionIndex uint32
+	DefaultSampleDuration  uint32
+	DefaultSampleSize      uint32
+	DefaultSampleFlags     uint32
+}
+
+func ParseTfhd(b Box) (*Tfhd, error) {
+	_, flags, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	t := &Tfhd{Flags: flags, TrackID: c.u32()}
+	if flags&TfhdBaseDataOffset != 0 {
+		t.BaseDataOffset = c.u64()
+	}
+	if flags&TfhdSampleDescriptionIndex != 0 {
+		t.SampleDescriptionIndex = c.u32()
+	}
+	if flags&TfhdDefaultSampleDuration != 0 {
+		t.DefaultSampleDuration = c.u32()
+	}
+	if flags&TfhdDefaultSampleSize != 0 {
+		t.DefaultSampleSize = c.u32()
+	}
+	if flags&TfhdDefaultSampleFlags != 0 {
+		t.DefaultSampleFlags = c.u32()
+	}
+	return t, c.err
+}
+
+func (t *Tfhd) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, t.TrackID)
+	if t.Flags&TfhdBaseDataOffset != 0 {
+		b = binary.BigEndian.AppendUint64(b, t.BaseDataOffset)
+	}
+	for _, f := range []struct {
+		flag  uint32
+		value uint32
+	}{
+		{TfhdSampleDescriptionIndex, t.SampleDescriptionIndex},
+		{TfhdDefaultSampleDuration, t.DefaultSampleDuration},
+		{TfhdDefaultSampleSize, t.DefaultSampleSize},
+		{TfhdDefaultSampleFlags, t.DefaultSampleFlags},
+	} {
+		if t.Flags&f.flag != 0 {
+			b = binary.BigEndian.AppendUint32(b, f.value)
+		}
+	}
+	return EncodeFull("tfhd", 0, t.Flags, b)
+}
+
+// Tfdt is the decode time of the first sample of a track fragment.
+type Tfdt struct {
+	Version             uint8
+	BaseMediaDecodeTime uint64
+}
+
+func ParseTfdt(b Box) (*Tfdt, error) {
+	version, _, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	t := &Tfdt{Version: version, BaseMediaDecodeTime: c.uint(version)}
+	return t, c.err
+}
+
+func (t *Tfdt) Encode() []byte {
+	version := t.Version
+	if t.BaseMediaDecodeTime > math.MaxUint32 {
+		version = 1
+	}
+	return EncodeFull("tfdt", version, 0, appendUint(nil, version, t.BaseMediaDecodeTime))
+}
+
+// Trun is a run of samples in a track fragment. Fields that the flags leave
+// out take their values from tfhd or trex.
+type Trun struct {
+	Version          uint8
+	Flags            uint32
+	DataOffset       int32
+	FirstSampleFlags uint32
+	Entries          []TrunEntry
+}
+
+type TrunEntry struct {
+	Duration uint32
+	Size     uint32
+	Flags    uint32
+	// CompositionOffset is unsigned in version 0 boxes, which never hold
+	// negative values.
+	CompositionOffset int32
+}
+
+func ParseTrun(b Box) (*Trun, error) {
+	version, flags, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	count := c.u32()
+	t := &Trun{Version: version, Flags: flags}
+	if flags&TrunDataOffset != 0 {
+		t.DataOffset = int32(c.u32())
+	}
+	if flags&TrunFirstSampleFlags != 0 {
+		t.FirstSampleFlags = c.u32()
+	}
+
+	// A corrupt count must not allocate gigabytes, so it is checked against the
+	// room left in the box first.
+	perEntry := 0
+	for _, f := range []uint32{TrunSampleDuration, TrunSampleSize, TrunSampleFlags, TrunSampleCompositionTime} {
+		if flags&f != 0 {
+			perEntry += 4
+		}
+	}
+	if c.err == nil && perEntry > 0 && int(count) > (len(c.p)-c.pos)/perEntry {
+		return nil, fmt.Errorf("trun has %d samples but room for %d", count, (len(c.p)-c.pos)/perEntry)
+	}
+
+	t.Entries = make([]TrunEntry, count)
+	for i := range t.Entries {
+		e := &t.Entries[i]
+		if flags&TrunSampleDuration != 0 {
+			e.Duration = c.u32()
+		}
+		if flags&TrunSampleSize != 0 {
+			e.Size = c.u32()
+		}
+		if flags&TrunSampleFlags != 0 {
+			e.Flags = c.u32()
+		}
+		if flags&TrunSampleCompositionTime != 0 {
+			e.CompositionOffset = int32(c.u32())
+		}
+	}
+	return t, c.err
+}
+
+func (t *Trun) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(t.Entries)))
+	if t.Flags&TrunDataOffset != 0 {
+		b = binary.BigEndian.AppendUint32(b, uint32(t.DataOffset))
+	}
+	if t.Flags&TrunFirstSampleFlags != 0 {
+		b = binary.BigEndian.AppendUint32(b, t.FirstSampleFlags)
+	}
+	for _, e := range t.Entries {
+		if t.Flags&TrunSampleDuration != 0 {
+			b = binary.BigEndian.AppendUint32(b, e.Duration)
+		}
+		if t.Flags&TrunSampleSize != 0 {
+			b = binary.BigEndian.AppendUint32(b, e.Size)
+		}
+		if t.Flags&TrunSampleFlags != 0 {
+			b = binary.BigEndian.AppendUint32(b, e.Flags)
+		}
+		if t.Flags&TrunSampleCompositionTime != 0 {
+			b = binary.BigEndian.AppendUint32(b, uint32(e.CompositionOffset))
+		}
+	}
+	return EncodeFull("trun", t.Version, t.Flags, b)
+}
+
+// SencUseSubsamples is the senc flag for samples split into clear and
+// protected ranges.
+const SencUseSubsamples = 0x000002
+
+// Senc holds the IV and subsample ranges of each encrypted sample.
+type Senc struct {
+	Version uint8
+	Flags   uint32
+	Samples []SencSample
+}
+
+type SencSample struct {
+	IV         []byte
+	Subsamples []Subsample
+}
+
+type Subsample struct {
+	Clear     uint16
+	Protected uint32
+}
+
+// maxEmptySencSamples bounds the sample count of a senc box whose samples
+// carry no data, far above what one fragment holds.
+const maxEmptySencSamples = 1 << 20
+
+// ParseSenc reads a senc box. ivSize is the per-sample IV size from tenc, 0
+// when the track uses a constant IV.
+func ParseSenc(b Box, ivSize int) (*Senc, error) {
+	version, flags, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	count := c.u32()
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	// As in trun, a corrupt count is checked against the room left in the box
+	// before anything is read. Samples with a constant IV and no subsamples
+	// take no room at all, so their count is bounded instead.
+	perSample := ivSize
+	if flags&SencUseSubsamples != 0 {
+		perSample += 2
+	}
+	room := len(c.p) - c.pos
+	switch {
+	case perSample > 0 && int(count) > room/perSample:
+		return nil, fmt.Errorf("senc has %d samples but room for %d", count, room/perSample)
+	case perSample == 0 && count > maxEmptySencSamples:
+		return nil, fmt.Errorf("senc has %d samples without data", count)
+	}
+
+	s := &Senc{Version: version, Flags: flags}
+	for i := uint32(0); i < count && c.err == nil; i++ {
+		var sample SencSample
+		sample.IV = append([]byte(nil), c.take(ivSize)...)
+		if flags&SencUseSubsamples != 0 {
+			n := c.u16()
+			for j := uint16(0); j < n && c.err == nil; j++ {
+				sample.Subsamples = append(sample.Subsamples, Subsample{Clear: c.u16(), Protected: c.u32()})
+			}
+		}
+		s.Samples = append(s.Samples, sample)
+	}
+	return s, c.err
+}
+
+func (s *Senc) Encode() []byte {
+	flags := s.Flags &^ SencUseSubsamples
+	for _, sample := range s.Samples {
+		if len(sample.Subsamples) > 0 {
+			flags |= SencUseSubsamples
+		}
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(s.Samples)))
+	for _, sample := range s.Samples {
+		b = append(b, sample.IV...)
+		if flags&SencUseSubsamples != 0 {
+			b = binary.BigEndian.AppendUint16(b, uint16(len(sample.Subsamples)))
+			for _, sub := range sample.Subsamples {
+				b = binary.BigEndian.AppendUint16(b, sub.Clear)
+				b = binary.BigEndian.AppendUint32(b, sub.Protected)
+			}
+		}
+	}
+	return EncodeFull("senc", s.Version, flags, b)
+}
+
+// Mdat is the media data box. Sample offsets in trun and stco point into it.
+type Mdat struct {
+	Offset     int64
+	HeaderSize int
+	Data       []byte
+}
+
+func ParseMdat(b Box) (*Mdat, error) {
+	if b.Type != "mdat" {
+		return nil, fmt.Errorf("%s is not an mdat box", b.Type)
+	}
+	return &Mdat{Offset: b.Offset, HeaderSize: b.HeaderSize, Data: b.Payload}, nil
+}
+
+func (m *Mdat) Encode() []byte {
+	return Encode("mdat", m.Data)
+}
@@ -0,0 +1,101 @@
+package bmff
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTfhdRoundTrip(t *testing.T) {
+	h := &Tfhd{
+		Flags:                  TfhdBaseDataOffset | TfhdSampleDescriptionIndex | TfhdDefaultSampleDuration | TfhdDefaultSampleSize | TfhdDefaultSampleFlags | TfhdDefaultBaseIsMoof,
+		TrackID:                2,
+		BaseDataOffset:         1 << 40,
+		SampleDescriptionIndex: 1,
+		DefaultSampleDuration:  1024,
+		DefaultSampleSize:      300,
+		DefaultSampleFlags:     0x01010000,
+	}
+	got := roundTrip(t, h.Encode(), ParseTfhd, (*Tfhd).Encode)
+	if *got != *h {
+		t.Errorf("got %+v, want %+v", got, h)
+	}
+}
+
+func TestTfdtRoundTrip(t *testing.T) {
+	for _, tfdt := range []*Tfdt{
+		{Version: 0, BaseMediaDecodeTime: 48000},
+		{Version: 1, BaseMediaDecodeTime: math.MaxUint32 + 1},
+	} {
+		got := roundTrip(t, tfdt.Encode(), ParseTfdt, (*Tfdt).Encode)
+		if *got != *tfdt {
+			t.Errorf("got %+v, want %+v", got, tfdt)
+		}
+	}
+}
+
+func TestTrunRoundTrip(t *testing.T) {
+	trun := &Trun{
+		Version:          1,
+		Flags:            TrunDataOffset | TrunFirstSampleFlags | TrunSampleDuration | TrunSampleSize | TrunSampleFlags | TrunSampleCompositionTime,
+		DataOffset:       -8,
+		FirstSampleFlags: 0x02000000,
+		Entries: []TrunEntry{
+			{Duration: 1001, Size: 5000, Flags: 0x02000000, CompositionOffset: 2002},
+			{Duration: 1001, Size: 700, Flags: 0x01010000, CompositionOffset: -1001},
+		},
+	}
+	got := roundTrip(t, trun.Encode(), ParseTrun, (*Trun).Encode)
+	if len(got.Entries) != 2 || got.Entries[1] != trun.Entries[1] || got.DataOffset != -8 {
+		t.Errorf("got %+v, want %+v", got, trun)
+	}
+}
+
+func TestTrunCorruptCount(t *testing.T) {
+	b := EncodeFull("trun", 0, TrunSampleSize, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 1})
+	if _, err := ParseTrun(parseOne(t, b)); err == nil {
+		t.Fatal("trun with more samples than room was accepted")
+	}
+}
+
+func TestSencRoundTrip(t *testing.T) {
+	senc := &Senc{
+		Flags: SencUseSubsamples,
+		Samples: []SencSample{
+			{IV: []byte{1, 2, 3, 4, 5, 6, 7, 8}, Subsamples: []Subsample{{Clear: 5, Protected: 1000}}},
+			{IV: []byte{9, 10, 11, 12, 13, 14, 15, 16}, Subsamples: []Subsample{{Clear: 5, Protected: 16}, {Clear: 2, Protected: 32}}},
+		},
+	}
+	parse := func(b Box) (*Senc, error) { return ParseSenc(b, 8) }
+	got := roundTrip(t, senc.Encode(), parse, (*Senc).Encode)
+	if len(got.Samples) != 2 || len(got.Samples[1].Subsamples) != 2 || got.Samples[1].Subsamples[1].Protected != 32 {
+		t.Errorf("got %+v", got.Samples)
+	}
+}
+
+func TestSencCorruptCount(t *testing.T) {
+	tests := []struct {
+		name   string
+		flags  uint32
+		ivSize int
+	}{
+		{"per-sample IV", 0, 8},
+		{"constant IV with subsamples", SencUseSubsamples, 0},
+		{"constant IV", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := EncodeFull("senc", 0, tt.flags, []byte{0xff, 0xff, 0xff, 0xff})
+			if _, err := ParseSenc(parseOne(t, b), tt.ivSize); err == nil {
+				t.Fatal("senc with a corrupt sample count was accepted")
+			}
+		})
+	}
+}
+
+func TestMdatRoundTrip(t *testing.T) {
+	m := &Mdat{Data: []byte("media")}
+	got := roundTrip(t, m.Encode(), ParseMdat, (*Mdat).Encode)
+	if got.HeaderSize != 8 || string(got.Data) != "media" {
+		t.Errorf("got %+v", got)
+	}
+}
@@ -0,0 +1,385 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Ftyp is the file type box.
+type Ftyp struct {
+	MajorBrand       string
+	MinorVersion     uint32
+	CompatibleBrands []string
+}
+
+func ParseFtyp(b Box) (*Ftyp, error) {
+	c := newCursor(b)
+	f := &Ftyp{MajorBrand: string(c.take(4)), MinorVersion: c.u32()}
+	for c.err == nil && c.pos+4 <= len(c.p) {
+		f.CompatibleBrands = append(f.CompatibleBrands, string(c.take(4)))
+	}
+	return f, c.err
+}
+
+func (f *Ftyp) Encode() []byte {
+	b := append([]byte(f.MajorBrand), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[4:], f.MinorVersion)
+	for _, brand := range f.CompatibleBrands {
+		b = append(b, brand...)
+	}
+	return Encode("ftyp", b)
+}
+
+// Mdhd is the media header box, which holds the timescale of a track.
+type Mdhd struct {
+	Version          uint8
+	CreationTime     uint64
+	ModificationTime uint64
+	Timescale        uint32
+	Duration         uint64
+	// Language is an ISO 639-2/T code such as "und".
+	Language string
+}
+
+func ParseMdhd(b Box) (*Mdhd, error) {
+	version, _, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	m := &Mdhd{Version: version}
+	m.CreationTime = c.uint(version)
+	m.ModificationTime = c.uint(version)
+	m.Timescale = c.u32()
+	m.Duration = c.uint(version)
+	lang := c.u16()
+	m.Language = string([]byte{byte(lang>>10&0x1f) + 0x60, byte(lang>>5&0x1f) + 0x60, byte(lang&0x1f) + 0x60})
+	return m, c.err
+}
+
+// Encode writes a version 1 box when a time does not fit version 0.
+func (m *Mdhd) Encode() []byte {
+	version := m.Version
+	if m.Duration > math.MaxUint32 || m.CreationTime > math.MaxUint32 || m.ModificationTime > math.MaxUint32 {
+		version = 1
+	}
+	var b []byte
+	b = appendUint(b, version, m.CreationTime)
+	b = appendUint(b, version, m.ModificationTime)
+	b = binary.BigEndian.AppendUint32(b, m.Timescale)
+	b = appendUint(b, version, m.Duration)
+	var lang uint16
+	if len(m.Language) == 3 {
+		for _, r := range []byte(m.Language) {
+			lang = lang<<5 | uint16(r-0x60)&0x1f
+		}
+	}
+	b = binary.BigEndian.AppendUint16(b, lang)
+	b = append(b, 0, 0)
+	return EncodeFull("mdhd", version, 0, b)
+}
+
+// Stsd is the sample description box. Each entry is a sample entry such as
+// avc1, mp4a, Opus or, for encrypted tracks, encv and enca.
+type Stsd struct {
+	Version uint8
+	Entries []Box
+}
+
+func ParseStsd(b Box) (*Stsd, error) {
+	version, _, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b.Payload) < 8 {
+		return nil, fmt.Errorf("truncated stsd box")
+	}
+	if b.Children == nil {
+		if b.Children, err = parse(b.Payload[8:], b.Offset+int64(b.HeaderSize)+8); err != nil {
+			return nil, fmt.Errorf("stsd: %v", err)
+		}
+	}
+	return &Stsd{Version: version, Entries: b.Children}, nil
+}
+
+func (s *Stsd) Encode() []byte {
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(s.Entries)))
+	for _, e := range s.Entries {
+		b = append(b, e.Bytes()...)
+	}
+	return EncodeFull("stsd", s.Version, 0, b)
+}
+
+// SampleEntry is the part of a sample entry that is common to every audio
+// or video codec, and the boxes that follow it, such as avcC, hvcC, esds,
+// dOps or sinf.
+type SampleEntry struct {
+	Type               string
+	DataReferenceIndex uint16
+	Audio              bool
+	Video              bool
+
+	ChannelCount uint16
+	SampleSize   uint16
+	SampleRate   uint32
+
+	Width  uint16
+	Height uint16
+
+	Children []Box
+}
+
+var (
+	audioEntries = map[string]bool{"mp4a": true, "Opus": true, "fLaC": true, "ac-3": true, "ec-3": true, "alac": true, "enca": true}
+	videoEntries = map[string]bool{"avc1": true, "avc3": true, "hvc1": true, "hev1": true, "vp09": true, "av01": true, "encv": true}
+)
+
+// ParseSampleEntry reads an audio or video sample entry.
+func ParseSampleEntry(b Box) (*SampleEntry, error) {
+	c := newCursor(b)
+	c.take(6)
+	e := &SampleEntry{Type: b.Type, DataReferenceIndex: c.u16()}
+
+	var skip int
+	switch {
+	case audioEntries[b.Type]:
+		e.Audio = true
+		c.take(8)
+		e.ChannelCount = c.u16()
+		e.SampleSize = c.u16()
+		c.take(4)
+		e.SampleRate = c.u32() >> 16
+		skip = 28
+	case videoEntries[b.Type]:
+		e.Video = true
+		c.take(16)
+		e.Width = c.u16()
+		e.Height = c.u16()
+		skip = 78
+	default:
+		return nil, fmt.Errorf("unknown sample entry %q", b.Type)
+	}
+	if c.err != nil || len(b.Payload) < skip {
+		return nil, fmt.Errorf("truncated %s sample entry", b.Type)
+	}
+
+	var err error
+	e.Children, err = parse(b.Payload[skip:], b.Offset+int64(b.HeaderSize+skip))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Type, err)
+	}
+	return e, nil
+}
+
+// OriginalFormat is the codec of an encrypted entry, read from its frma box,
+// or the entry type when it is not encrypted.
+func (e *SampleEntry) OriginalFormat() string {
+	if frma, ok := Find(e.Children, "sinf", "frma"); ok && len(frma.Payload) >= 4 {
+		return string(frma.Payload[:4])
+	}
+	return e.Type
+}
+
+// Tenc returns the track encryption box of an encrypted entry.
+func (e *SampleEntry) Tenc() (*Tenc, error) {
+	b, ok := Find(e.Children, "sinf", "schi", "tenc")
+	if !ok {
+		return nil, fmt.Errorf("%s sample entry has no tenc box", e.Type)
+	}
+	return ParseTenc(b)
+}
+
+// Tenc is the track encryption box of Common Encryption (ISO/IEC 23001-7).
+type Tenc struct {
+	Version                uint8
+	DefaultCryptByteBlock  uint8
+	DefaultSkipByteBlock   uint8
+	DefaultIsProtected     uint8
+	DefaultPerSampleIVSize uint8
+	DefaultKID             [16]byte
+	// DefaultConstantIV is set when DefaultPerSampleIVSize is 0.
+	DefaultConstantIV []byte
+}
+
+func ParseTenc(b Box) (*Tenc, error) {
+	version, _, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	t := &Tenc{Version: version}
+	c.u8()
+	pattern := c.u8()
+	if version > 0 {
+		t.DefaultCryptByteBlock = pattern >> 4
+		t.DefaultSkipByteBlock = pattern & 0x0f
+	}
+	t.DefaultIsProtected = c.u8()
+	t.DefaultPerSampleIVSize = c.u8()
+	t.DefaultKID = c.kid()
+	if t.DefaultIsProtected == 1 && t.DefaultPerSampleIVSize == 0 {
+		n := int(c.u8())
+		t.DefaultConstantIV = append([]byte(nil), c.take(n)...)
+	}
+	return t, c.err
+}
+
+func (t *Tenc) Encode() []byte {
+	b := []byte{0, 0}
+	if t.Version > 0 {
+		b[1] = t.DefaultCryptByteBlock<<4 | t.DefaultSkipByteBlock&0x0f
+	}
+	b = append(b, t.DefaultIsProtected, t.DefaultPerSampleIVSize)
+	b = append(b, t.DefaultKID[:]...)
+	if t.DefaultIsProtected == 1 && t.DefaultPerSampleIVSize == 0 {
+		b = append(b, byte(len(t.DefaultConstantIV)))
+		b = append(b, t.DefaultConstantIV...)
+	}
+	return EncodeFull("tenc", t.Version, 0, b)
+}
+
+// Pssh is a protection system specific header box, which carries the data a
+// DRM system needs to find the keys of a file.
+type Pssh struct {
+	Version  uint8
+	SystemID [16]byte
+	// KIDs is only present in version 1 boxes.
+	KIDs [][16]byte
+	Data []byte
+}
+
+func ParsePssh(b Box) (*Pssh, error) {
+	version, _, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	p := &Pssh{Version: version, SystemID: c.kid()}
+	if version > 0 {
+		n := c.u32()
+		for i := uint32(0); i < n && c.err == nil; i++ {
+			p.KIDs = append(p.KIDs, c.kid())
+		}
+	}
+	size := c.u32()
+	p.Data = append([]byte(nil), c.take(int(size))...)
+	return p, c.err
+}
+
+func (p *Pssh) Encode() []byte {
+	b := append([]byte(nil), p.SystemID[:]...)
+	version := p.Version
+	if len(p.KIDs) > 0 {
+		version = 1
+	}
+	if version > 0 {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(p.KIDs)))
+		for _, kid := range p.KIDs {
+			b = append(b, kid[:]...)
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(p.Data)))
+	b = append(b, p.Data...)
+	return EncodeFull("pssh", version, 0, b)
+}
+
+// Moov is the movie box, reduced to what is needed to tell tracks apart and
+// to find their keys.
+type Moov struct {
+	Timescale  uint32
+	Duration   uint64
+	Fragmented bool
+	Traks      []Trak
+	Pssh       []Pssh
+}
+
+// Trak is one track of a movie.
+type Trak struct {
+	ID      uint32
+	Handler string
+	Mdhd    *Mdhd
+	Stsd    *Stsd
+	Box     Box
+}
+
+func ParseMoov(b Box) (*Moov, error) {
+	m := &Moov{}
+
+	mvhd, ok := b.Find("mvhd")
+	if !ok {
+		return nil, fmt.Errorf("moov has no mvhd box")
+	}
+	version, _, err := fullHeader(mvhd)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(mvhd)
+	c.u32()
+	c.uint(version)
+	c.uint(version)
+	m.Timescale = c.u32()
+	m.Duration = c.uint(version)
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	_, m.Fragmented = b.Find("mvex")
+
+	for _, child := range b.Children {
+		switch child.Type {
+		case "trak":
+			t, err := ParseTrak(child)
+			if err != nil {
+				return nil, err
+			}
+			m.Traks = append(m.Traks, *t)
+		case "pssh":
+			p, err := ParsePssh(child)
+			if err != nil {
+				return nil, err
+			}
+			m.Pssh = append(m.Pssh, *p)
+		}
+	}
+	return m, nil
+}
+
+func ParseTrak(b Box) (*Trak, error) {
+	t := &Trak{Box: b}
+
+	tkhd, ok := b.Find("tkhd")
+	if !ok {
+		return nil, fmt.Errorf("trak has no tkhd box")
+	}
+	version, _, err := fullHeader(tkhd)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(tkhd)
+	c.u32()
+	c.uint(version)
+	c.uint(version)
+	t.ID = c.u32()
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	if hdlr, ok := b.Find("mdia", "hdlr"); ok && len(hdlr.Payload) >= 12 {
+		t.Handler = string(hdlr.Payload[8:12])
+	}
+	if mdhd, ok := b.Find("mdia", "mdhd"); ok {
+		if t.Mdhd, err = ParseMdhd(mdhd); err != nil {
+			return nil, err
+		}
+	}
+	if stsd, ok := b.Find("mdia", "minf", "stbl", "stsd"); ok {
+		if t.Stsd, err = ParseStsd(stsd); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,63 @@
+package bmff
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestFtypRoundTrip(t *testing.T) {
+	f := &Ftyp{MajorBrand: "iso6", MinorVersion: 512, CompatibleBrands: []string{"iso6", "dash", "mp41"}}
+	got := roundTrip(t, f.Encode(), ParseFtyp, (*Ftyp).Encode)
+	if got.MajorBrand != "iso6" || !slices.Equal(got.CompatibleBrands, f.CompatibleBrands) {
+		t.Errorf("got %+v, want %+v", got, f)
+	}
+}
+
+func TestMdhdRoundTrip(t *testing.T) {
+	for _, m := range []*Mdhd{
+		{Timescale: 48000, Duration: 48000 * 180, Language: "eng"},
+		{Version: 1, Timescale: 90000, Duration: math.MaxUint32 + 1, Language: "und"},
+	} {
+		got := roundTrip(t, m.Encode(), ParseMdhd, (*Mdhd).Encode)
+		if *got != *m {
+			t.Errorf("got %+v, want %+v", got, m)
+		}
+	}
+}
+
+func TestStsdRoundTrip(t *testing.T) {
+	entry := Encode("Opus", make([]byte, 28), Encode("dOps", []byte{0, 2, 1, 56, 0, 0, 187, 128, 0, 0, 0}))
+	buf := EncodeFull("stsd", 0, 0, []byte{0, 0, 0, 1}, entry)
+	got := roundTrip(t, buf, ParseStsd, (*Stsd).Encode)
+	if len(got.Entries) != 1 || got.Entries[0].Type != "Opus" {
+		t.Errorf("got entries %+v", got.Entries)
+	}
+}
+
+func TestTencRoundTrip(t *testing.T) {
+	kid := [16]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef}
+	for _, tenc := range []*Tenc{
+		{DefaultIsProtected: 1, DefaultPerSampleIVSize: 8, DefaultKID: kid},
+		{Version: 1, DefaultCryptByteBlock: 1, DefaultSkipByteBlock: 9, DefaultIsProtected: 1, DefaultKID: kid, DefaultConstantIV: bytes.Repeat([]byte{7}, 16)},
+	} {
+		got := roundTrip(t, tenc.Encode(), ParseTenc, (*Tenc).Encode)
+		if got.DefaultKID != kid || got.DefaultSkipByteBlock != tenc.DefaultSkipByteBlock || !bytes.Equal(got.DefaultConstantIV, tenc.DefaultConstantIV) {
+			t.Errorf("got %+v, want %+v", got, tenc)
+		}
+	}
+}
+
+func TestPsshRoundTrip(t *testing.T) {
+	system := [16]byte{0xed, 0xef, 0x8b, 0xa9, 0x79, 0xd6, 0x4a, 0xce, 0xa3, 0xc8, 0x27, 0xdc, 0xd5, 0x1d, 0x21, 0xed}
+	for _, p := range []*Pssh{
+		{SystemID: system, Data: []byte{0x12, 0x10}},
+		{Version: 1, SystemID: system, KIDs: [][16]byte{{1}, {2}}, Data: []byte{}},
+	} {
+		got := roundTrip(t, p.Encode(), ParsePssh, (*Pssh).Encode)
+		if got.Version != p.Version || !slices.Equal(got.KIDs, p.KIDs) || !bytes.Equal(got.Data, p.Data) {
+			t.Errorf("got %+v, want %+v", got, p)
+		}
+	}
+}
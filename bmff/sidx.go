@@ -0,0 +1,87 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Sidx is a segment index: the byte size and duration of each subsegment of a
+// file, counted from the first byte after the sidx box plus FirstOffset.
+type Sidx struct {
+	Version                  uint8
+	ReferenceID              uint32
+	Timescale                uint32
+	EarliestPresentationTime uint64
+	FirstOffset              uint64
+	References               []SidxReference
+}
+
+// SidxReference is one subsegment, or with ReferenceType 1 another sidx box.
+type SidxReference struct {
+	ReferenceType      uint8
+	ReferencedSize     uint32
+	SubsegmentDuration uint32
+	StartsWithSAP      bool
+	SAPType            uint8
+	SAPDeltaTime       uint32
+}
+
+func ParseSidx(b Box) (*Sidx, error) {
+	version, _, err := fullHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	c := newCursor(b)
+	c.u32()
+	s := &Sidx{Version: version, ReferenceID: c.u32(), Timescale: c.u32()}
+	s.EarliestPresentationTime = c.uint(version)
+	s.FirstOffset = c.uint(version)
+	c.u16()
+	count := c.u16()
+	if c.err != nil {
+		return nil, c.err
+	}
+	if int(count) > (len(c.p)-c.pos)/12 {
+		return nil, fmt.Errorf("sidx has %d references but room for %d", count, (len(c.p)-c.pos)/12)
+	}
+
+	s.References = make([]SidxReference, count)
+	for i := range s.References {
+		ref := c.u32()
+		duration := c.u32()
+		sap := c.u32()
+		s.References[i] = SidxReference{
+			ReferenceType:      uint8(ref >> 31),
+			ReferencedSize:     ref & 0x7fffffff,
+			SubsegmentDuration: duration,
+			StartsWithSAP:      sap>>31 == 1,
+			SAPType:            uint8(sap >> 28 & 0x7),
+			SAPDeltaTime:       sap & 0x0fffffff,
+		}
+	}
+	return s, c.err
+}
+
+func (s *Sidx) Encode() []byte {
+	version := s.Version
+	if s.EarliestPresentationTime > math.MaxUint32 || s.FirstOffset > math.MaxUint32 {
+		version = 1
+	}
+	b := binary.BigEndian.AppendUint32(nil, s.ReferenceID)
+	b = binary.BigEndian.AppendUint32(b, s.Timescale)
+	b = appendUint(b, version, s.EarliestPresentationTime)
+	b = appendUint(b, version, s.FirstOffset)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s.References)))
+	for _, r := range s.References {
+		b = binary.BigEndian.AppendUint32(b, uint32(r.ReferenceType)<<31|r.ReferencedSize&0x7fffffff)
+		b = binary.BigEndian.AppendUint32(b, r.SubsegmentDuration)
+		sap := uint32(r.SAPType&0x7)<<28 | r.SAPDeltaTime&0x0fffffff
+		if r.StartsWithSAP {
+			sap |= 1 << 31
+		}
+		b = binary.BigEndian.AppendUint32(b, sap)
+	}
+	return EncodeFull("sidx", version, 0, b)
+}
@@ -0,0 +1,30 @@
+package bmff
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestSidxRoundTrip(t *testing.T) {
+	refs := []SidxReference{
+		{ReferencedSize: 40000, SubsegmentDuration: 96000, StartsWithSAP: true, SAPType: 1},
+		{ReferenceType: 1, ReferencedSize: 1200, SubsegmentDuration: 48000, SAPDeltaTime: 5},
+	}
+	for _, s := range []*Sidx{
+		{ReferenceID: 1, Timescale: 48000, EarliestPresentationTime: 0, FirstOffset: 0, References: refs},
+		{Version: 1, ReferenceID: 1, Timescale: 48000, EarliestPresentationTime: math.MaxUint32 + 1, FirstOffset: 16, References: refs},
+	} {
+		got := roundTrip(t, s.Encode(), ParseSidx, (*Sidx).Encode)
+		if got.EarliestPresentationTime != s.EarliestPresentationTime || !slices.Equal(got.References, s.References) {
+			t.Errorf("got %+v, want %+v", got, s)
+		}
+	}
+}
+
+func TestSidxCorruptCount(t *testing.T) {
+	b := EncodeFull("sidx", 0, 0, make([]byte, 18), []byte{0xff, 0xff})
+	if _, err := ParseSidx(parseOne(t, b)); err == nil {
+		t.Fatal("sidx with more references than room was accepted")
+	}
+}
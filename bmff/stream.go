@@ -0,0 +1,182 @@
+package bmff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Reader reads boxes one after another from a stream, so that large boxes
+// such as mdat can be skipped or copied without holding them in memory.
+type Reader struct {
+	r      io.Reader
+	offset int64
+	header Header
+	// left is what remains of the current payload, or -1 when the box runs to
+	// the end of the stream. read is what was read of it.
+	left int64
+	read int64
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// Next skips what is left of the current box and reads the header of the next
+// one. It returns io.EOF when the stream ends between boxes.
+func (r *Reader) Next() (Header, error) {
+	if err := r.skip(); err != nil {
+		return Header{}, err
+	}
+
+	buf := make([]byte, 8, 32)
+	n, err := io.ReadFull(r.r, buf)
+	if err == io.EOF {
+		return Header{}, io.EOF
+	}
+	if err != nil {
+		return Header{}, fmt.Errorf("truncated box header at offset %d", r.offset+int64(n))
+	}
+	if binary.BigEndian.Uint32(buf[0:4]) == 1 {
+		buf = buf[:16]
+		if _, err := io.ReadFull(r.r, buf[8:]); err != nil {
+			return Header{}, fmt.Errorf("truncated large size box header at offset %d", r.offset)
+		}
+	}
+	if string(buf[4:8]) == "uuid" {
+		buf = append(buf, make([]byte, 16)...)
+		if _, err := io.ReadFull(r.r, buf[len(buf)-16:]); err != nil {
+			return Header{}, fmt.Errorf("truncated uuid box header at offset %d", r.offset)
+		}
+	}
+
+	h, err := parseHeader(buf, r.offset)
+	if err != nil {
+		return Header{}, err
+	}
+	if h.Size != 0 && h.Size < int64(h.HeaderSize) {
+		return Header{}, fmt.Errorf("invalid %s box size %d at offset %d", h.Type, h.Size, r.offset)
+	}
+
+	r.header = h
+	r.offset += int64(h.HeaderSize)
+	r.read = 0
+	r.left = -1
+	if h.Size != 0 {
+		r.left = h.Size - int64(h.HeaderSize)
+	}
+	return h, nil
+}
+
+// Read reads from the payload of the current box.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if r.left > 0 && int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.offset += int64(n)
+	r.read += int64(n)
+	if r.left > 0 {
+		r.left -= int64(n)
+		if err == io.EOF && r.left > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	return n, err
+}
+
+// Box reads the rest of the current box and parses its children.
+func (r *Reader) Box() (Box, error) {
+	h := r.header
+	if r.read != 0 {
+		return Box{}, fmt.Errorf("%s box at offset %d was partly read", h.Type, h.Offset)
+	}
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return Box{}, fmt.Errorf("%s box at offset %d: %v", h.Type, h.Offset, err)
+	}
+
+	// The header is written back as it was, so that offsets stay right.
+	size := int64(h.HeaderSize + len(payload))
+	buf := make([]byte, 0, size)
+	if h.HeaderSize == 16 || h.HeaderSize == 32 {
+		buf = binary.BigEndian.AppendUint32(buf, 1)
+		buf = append(buf, h.Type...)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(size))
+	} else {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(size))
+		buf = append(buf, h.Type...)
+	}
+	if h.Type == "uuid" {
+		buf = append(buf, h.UserType[:]...)
+	}
+	buf = append(buf, payload...)
+
+	b, err := parseBox(buf, h.Offset)
+	if err != nil {
+		return b, err
+	}
+	b.Offset = h.Offset
+	return b, nil
+}
+
+// Offset is the position in the stream.
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+func (r *Reader) skip() error {
+	if r.left == 0 {
+		return nil
+	}
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return err
+	}
+	if r.left > 0 {
+		return fmt.Errorf("%s box at offset %d is truncated after %d bytes", r.header.Type, r.header.Offset, n)
+	}
+	r.left = 0
+	return nil
+}
+
+// Writer writes boxes to a stream and keeps count of the offset.
+type Writer struct {
+	w      io.Writer
+	offset int64
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteBox writes a whole box.
+func (w *Writer) WriteBox(b Box) error {
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// WriteHeader starts a box whose payload of size bytes is written next with
+// Write.
+func (w *Writer) WriteHeader(typ string, size int64) error {
+	if size < 0 {
+		return errors.New("negative box size")
+	}
+	_, err := w.Write(appendHeader(nil, typ, size+8))
+	return err
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	return n, err
+}
+
+// Offset is the number of bytes written so far.
+func (w *Writer) Offset() int64 {
+	return w.offset
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// clipPreroll is how much media is kept before the start of a clip. Decoders
+// such as Opus need it to settle after starting partway through a stream; the
+// edit list hides it again. Downloads also keep it after the end, because
+// edit lists shift presentation times by a few milliseconds of priming.
+const clipPreroll = 0.08
+
+// timeRange is the part of a song to keep, in seconds. end is 0 when the
+// range runs to the end of the song.
+type timeRange struct {
+	start float64
+	end   float64
+}
+
+func (r timeRange) set() bool {
+	return r.start > 0 || r.end > 0
+}
+
+// overlaps reports whether media from start to end is needed for the range,
+// counting the preroll.
+func (r timeRange) overlaps(start, end float64) bool {
+	return end > r.start-clipPreroll && (r.end == 0 || start < r.end+clipPreroll)
+}
+
+// from measures the range from a point of the song instead of its start.
+func (r timeRange) from(origin float64) timeRange {
+	r.start -= origin
+	if r.end > 0 {
+		r.end -= origin
+	}
+	return r
+}
+
+func (r timeRange) String() string {
+	if r.end == 0 {
+		return fmt.Sprintf("%s-", formatTimestamp(r.start))
+	}
+	return fmt.Sprintf("%s-%s", formatTimestamp(r.start), formatTimestamp(r.end))
+}
+
+// clipFlags are --start and --end as given on the command line.
+type clipFlags struct {
+	start string
+	end   string
+}
+
+func (c *clipFlags) timeRange() (timeRange, error) {
+	var r timeRange
+	var err error
+	if c.start != "" {
+		if r.start, err = parseTimestamp(c.start); err != nil {
+			return r, fmt.Errorf("--start: %v", err)
+		}
+	}
+	if c.end != "" {
+		if r.end, err = parseTimestamp(c.end); err != nil {
+			return r, fmt.Errorf("--end: %v", err)
+		}
+		if r.end <= r.start {
+			return r, fmt.Errorf("--end %s is not after --start %s", c.end, c.start)
+		}
+	}
+	return r, nil
+}
+
+// parseTimestamp reads a time given in seconds, such as "90" or "90.5", or
+// with minutes and hours, such as "1:30" or "01:02:03.25".
+func parseTimestamp(s string) (float64, error) {
+	parts := strings.Split(strings.TrimSpace(s), ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid time %q, expected [[hh:]mm:]ss", s)
+	}
+
+	var seconds float64
+	for i, p := range parts {
+		last := i == len(parts)-1
+		var v float64
+		var err error
+		if last {
+			v, err = strconv.ParseFloat(p, 64)
+		} else {
+			var n int
+			n, err = strconv.Atoi(p)
+			v = float64(n)
+		}
+		if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) || (i > 0 && v >= 60) {
+			return 0, fmt.Errorf("invalid time %q, expected [[hh:]mm:]ss", s)
+		}
+		seconds = seconds*60 + v
+	}
+	return seconds, nil
+}
+
+func formatTimestamp(seconds float64) string {
+	m := int(seconds) / 60
+	return fmt.Sprintf("%02d:%06.3f", m, seconds-float64(m*60))
+}
+
+// clipTrack cuts a downloaded track down to a time range, in place.
+func clipTrack(track TrackDownload, r timeRange) error {
+	clipped := track.OutputPath + ".clip"
+	if err := clipMP4(track.OutputPath, clipped, track.clipRange(r)); err != nil {
+		os.Remove(clipped)
+		return withExit(exitMux, fmt.Errorf("error clipping %s track to %s: %v", track.MediaType, r, err))
+	}
+	return os.Rename(clipped, track.OutputPath)
+}
+
+// clipRange is where a time range lies in the downloaded track. Decryption
+// restarts a track at 0, so a decrypted track starts at the first downloaded
+// segment rather than at its decode time in the song.
+func (t TrackDownload) clipRange(r timeRange) timeRange {
+	if t.Key == "" {
+		return r
+	}
+	return r.from(t.Start)
+}
+
+// clipMP4 writes the part of an MP4 that lies in a time range. Tracks are
+// cut at whole samples, video at a sync sample, and an edit list trims them to
+// the exact range. The file stays fragmented if it was.
+func clipMP4(src, dst string, r timeRange) error {
+	m, err := newMP4Muxer([]string{src})
+	if err != nil {
+		return err
+	}
+	for _, t := range m.tracks {
+		if err := t.clip(r, m.movieTimescale); err != nil {
+			return fmt.Errorf("track %d: %v", t.mp4Track.id, err)
+		}
+	}
+	if m.fragmented() {
+		return m.writeFragmented(dst)
+	}
+	return m.writeProgressive(dst)
+}
+
+// clip drops the samples of a track outside a time range, keeping the preroll,
+// and sets an edit list that starts and ends playback on the range.
+func (t *muxTrack) clip(r timeRange, movieTimescale uint32) error {
+	ts := float64(t.timescale)
+
+	// Media time is presentation time shifted by the start of the track's edit,
+	// which is how priming samples are skipped.
+	var shift int64
+	if t.hasEdit {
+		shift = t.editStart
+	}
+	mediaEnd := int64(t.baseTime + t.mediaDuration())
+	end := float64(mediaEnd-shift) / ts
+	if t.hasEdit && t.editDuration > 0 {
+		end = min(end, float64(t.editDuration)/float64(t.movieTimescale))
+	}
+	if r.end > 0 {
+		end = min(end, r.end)
+	}
+	if r.start >= end {
+		return fmt.Errorf("the track ends at %s, before the clip starts", formatTimestamp(end))
+	}
+
+	target := int64(math.Round(r.start*ts)) + shift
+	from := target - int64(math.Round(clipPreroll*ts))
+	until := int64(math.Round(end*ts)) + shift
+
+	first, last := 0, len(t.samples)
+	firstTime := int64(t.baseTime)
+	dts := int64(t.baseTime)
+	for i, s := range t.samples {
+		if dts >= until {
+			last = i
+			break
+		}
+		if s.sync() && dts <= from {
+			first, firstTime = i, dts
+		}
+		dts += int64(s.duration)
+	}
+	if first >= last {
+		return fmt.Errorf("no samples between %s and %s", formatTimestamp(r.start), formatTimestamp(end))
+	}
+	t.samples = t.samples[first:last]
+
+	t.edit = &mp4Edit{
+		duration:  uint64(math.Round((end - r.start) * float64(movieTimescale))),
+		mediaTime: max(target-firstTime, 0),
+		rate:      0x00010000,
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import "testing"
+
+// clipTestTrack is a track of one-second sync samples whose first fragment
+// starts at baseTime, in a timescale of 1000.
+func clipTestTrack(baseTime uint64, samples int) *muxTrack {
+	t := &mp4Track{timescale: 1000, movieTimescale: 1000, baseTime: baseTime, fragmented: true}
+	for i := 0; i < samples; i++ {
+		t.samples = append(t.samples, mp4Sample{offset: int64(i), size: 1, duration: 1000, flags: sampleFlagsSync})
+	}
+	return &muxTrack{mp4Track: t}
+}
+
+func TestClipTrackNotStartingAtZero(t *testing.T) {
+	r := timeRange{start: 5, end: 7}
+
+	tests := []struct {
+		name     string
+		download TrackDownload
+		baseTime uint64
+	}{
+		// Unencrypted fragments keep their decode time in the song.
+		{"tfdt", TrackDownload{Start: 4}, 4000},
+		// Decryption restarts the track at 0.
+		{"decrypted", TrackDownload{Start: 4, Key: "00112233445566778899aabbccddeeff"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			track := clipTestTrack(tt.baseTime, 6)
+			if err := track.clip(tt.download.clipRange(r), 1000); err != nil {
+				t.Fatal(err)
+			}
+			// The samples at song time 4 to 7: the one before 5 holds the
+			// preroll.
+			if len(track.samples) != 3 || track.samples[0].offset != 0 {
+				t.Fatalf("kept %d samples from offset %d, want 3 from 0", len(track.samples), track.samples[0].offset)
+			}
+			if track.edit.mediaTime != 1000 || track.edit.duration != 2000 {
+				t.Errorf("edit starts at %d for %d, want 1000 for 2000", track.edit.mediaTime, track.edit.duration)
+			}
+		})
+	}
+}
+
+func TestTimeRangeFrom(t *testing.T) {
+	if got := (timeRange{start: 5, end: 7}).from(4); got != (timeRange{start: 1, end: 3}) {
+		t.Errorf("got %v", got)
+	}
+	// An open end stays open.
+	if got := (timeRange{start: 5}).from(4); got != (timeRange{start: 1}) {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestNoSegmentsError(t *testing.T) {
+	if err := (TrackDownload{}).noSegments(); err.Error() != "manifest lists no segments" {
+		t.Errorf("without a clip: %v", err)
+	}
+	if err := (TrackDownload{Clip: timeRange{start: 5}}).noSegments(); err.Error() != "no segments cover "+(timeRange{start: 5}).String() {
+		t.Errorf("with a clip: %v", err)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type keyFlags struct {
+	keystore string
+	key      string
+	bearer   string
+}
+
+func addKeyFlags(fs *flag.FlagSet) *keyFlags {
+	k := &keyFlags{}
+	fs.StringVar(&k.keystore, "keys", "keys.bin", "keystore used to decrypt the blurl envelope")
+	fs.StringVar(&k.key, "key", "", "content key as hex, skips the keystore")
+	fs.StringVar(&k.bearer, "bearer", "", "bearer token for Festival envelopes, skips the keystore")
+	return k
+}
+
+// provider builds the key provider once commonFlags.apply has run, so that
+// its errors are logged like any other. The keystore must have been looked up
+// with lookupKeystore first.
+func (k *keyFlags) provider() (KeyProvider, error) {
+	p, err := newKeyProvider(k.keystore, k.key, k.bearer)
+	if err != nil {
+		return nil, withExit(exitUsage, err)
+	}
+	return p, nil
+}
+
+// lookupKeystore finds a relative keystore before -C changes the working
+// directory, keeping the fallback to the executable's directory.
+func lookupKeystore(path string) string {
+	if path == "" {
+		return ""
+	}
+	return findKeystore(path)
+}
+
+func inputAndOutput(fs *flag.FlagSet, positional []string, output string) (string, string, error) {
+	if len(positional) < 1 || len(positional) > 2 {
+		fs.Usage()
+		return "", "", withExit(exitUsage, errUsage)
+	}
+	if len(positional) == 2 {
+		if output != "" && output != positional[1] {
+			return "", "", withExit(exitUsage, fmt.Errorf("output given both as argument and with -o"))
+		}
+		output = positional[1]
+	}
+	return positional[0], output, nil
+}
+
+func addTrackFlags(fs *flag.FlagSet, opts *convertOptions) *clipFlags {
+	clip := &clipFlags{}
+	fs.StringVar(&opts.output, "o", "", "output file or directory")
+	fs.StringVar(&opts.output, "output", "", "output file or directory")
+	fs.IntVar(&opts.selector.index, "index", 0, "playlist number to use (1-based)")
+	fs.IntVar(&opts.selector.index, "playlist", 0, "alias for --index")
+	fs.StringVar(&opts.selector.language, "language", "", "use the playlist with this language, e.g. en")
+	fs.StringVar(&opts.selector.typ, "playlist-type", "", "use the playlist with this type")
+	fs.BoolVar(&opts.selector.all, "all-playlists", false, "convert every matching playlist into language-suffixed outputs")
+	fs.BoolVar(&opts.selector.preview, "preview-only", false, "use the preview playlists of a blurl that has both previews and full songs")
+	fs.IntVar(&opts.concurrency, "concurrency", defaultConcurrency, "number of segments downloaded in parallel")
+	fs.IntVar(&opts.jobs, "jobs", 1, "number of inputs converted in parallel")
+	fs.BoolVar(&opts.keepTemp, "keep-temp", false, "keep the temporary workspace of each job for debugging")
+	fs.BoolVar(&opts.defragment, "defragment", false, "write mp4 output as a regular MP4 with its moov first instead of fragments")
+	fs.StringVar(&clip.start, "start", "", "only download and convert the song from this time, e.g. 00:30")
+	fs.StringVar(&clip.end, "end", "", "only download and convert the song up to this time, e.g. 01:00")
+	fs.StringVar(&opts.outputTemplate, "output-template", "", "name outputs from a template below the output directory, e.g. {assetId}/{language}_{type}_{stem}.{ext}")
+	fs.BoolVar(&opts.force, "force", false, "overwrite existing outputs")
+	fs.BoolVar(&opts.reportKeys, "report-keys", false, "write the content key into the .report.json reports")
+	fs.Func("tag", "add a metadata tag to the outputs, KEY=value (repeatable)", func(s string) error {
+		t, err := parseTag(s)
+		if err != nil {
+			return err
+		}
+		opts.tags = withTags(opts.tags, t)
+		return nil
+	})
+	return clip
+}
+
+func cmdConvert(args []string) error {
+	fs := newFlagSet("convert")
+	common := addCommonFlags(fs)
+	keys := addKeyFlags(fs)
+	opts := convertOptions{decrypt: true}
+	clip := addTrackFlags(fs, &opts)
+	fs.StringVar(&opts.format, "format", "mp4", "output format: mp4, opus, wav or flac")
+	var decoder, stemMap, mix string
+	var splitStems bool
+	fs.StringVar(&decoder, "decoder", "ffmpeg", "decoder used for wav and flac output")
+	fs.BoolVar(&splitStems, "split-stems", false, "write one file per stem of a multitrack audio track (wav unless --format flac)")
+	fs.StringVar(&stemMap, "stem-map", festivalStemMap, "stems and their channels, counted from 1")
+	fs.StringVar(&mix, "mix", "", "write a stereo mixdown of the stems with these gains or presets, e.g. karaoke,drums=-3dB")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := validateConvertOptions(opts); err != nil {
+		return withExit(exitUsage, err)
+	}
+	opts.clip, err = clip.timeRange()
+	if err != nil {
+		return withExit(exitUsage, err)
+	}
+
+	opts.decoder, err = newDecoder(decoder)
+	if err != nil {
+		return withExit(exitUsage, err)
+	}
+
+	if splitStems && mix != "" {
+		return withExit(exitUsage, fmt.Errorf("--split-stems and --mix cannot be used together"))
+	}
+	if splitStems || mix != "" {
+		flag := "--split-stems"
+		if mix != "" {
+			flag = "--mix"
+		}
+		switch opts.format {
+		case "mp4":
+			opts.format = "wav"
+		case "wav", "flac":
+		default:
+			return withExit(exitUsage, fmt.Errorf("%s writes wav or flac, not %s", flag, opts.format))
+		}
+		opts.stems, err = parseStemMap(stemMap)
+		if err != nil {
+			return withExit(exitUsage, fmt.Errorf("--stem-map: %v", err))
+		}
+	}
+	if mix != "" {
+		opts.mix, err = parseMix(mix, opts.stems)
+		if err != nil {
+			return withExit(exitUsage, fmt.Errorf("--mix: %v", err))
+		}
+	}
+
+	return runConvert(fs, common, keys, positional, opts)
+}
+
+// runConvert converts a single input in place, or hands several inputs,
+// directories and globs to the batch runner. keys is nil when the tracks are
+// not decrypted.
+func runConvert(fs *flag.FlagSet, common *commonFlags, keys *keyFlags, positional []string, opts convertOptions) error {
+	positional, output, err := splitOutput(positional, opts.output)
+	if err != nil {
+		return withExit(exitUsage, err)
+	}
+	if len(positional) == 0 {
+		fs.Usage()
+		return withExit(exitUsage, errUsage)
+	}
+
+	paths := []*string{&output}
+	for i := range positional {
+		paths = append(paths, &positional[i])
+	}
+	if keys != nil {
+		keys.keystore = lookupKeystore(keys.keystore)
+	}
+	if err := common.apply(paths...); err != nil {
+		return err
+	}
+	if common.workdir != "" {
+		opts.tempDir = "."
+	}
+	if keys != nil {
+		opts.keys, err = keys.provider()
+		if err != nil {
+			return err
+		}
+	}
+
+	inputs, err := expandInputs(positional)
+	if err != nil {
+		return withExit(exitInput, err)
+	}
+
+	if len(inputs) == 1 && !inputs[0].walked && !inputs[0].matched {
+		return convertFile(&job{input: inputs[0].path, output: output}, opts)
+	}
+	if len(inputs) == 0 {
+		return withExit(exitInput, fmt.Errorf("no blurl files found in %s", strings.Join(positional, ", ")))
+	}
+	return runBatch(inputs, output, opts.jobs, opts)
+}
+
+func validateConvertOptions(opts convertOptions) error {
+	switch opts.format {
+	case "mp4", "opus", "wav", "flac":
+	default:
+		return fmt.Errorf("unknown format %q", opts.format)
+	}
+	if opts.concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1")
+	}
+	if opts.jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1")
+	}
+	if opts.defragment && opts.format != "mp4" {
+		return fmt.Errorf("--defragment only applies to mp4 output")
+	}
+	// Rewriting a track needs its samples in the clear.
+	if opts.defragment && !opts.decrypt {
+		return fmt.Errorf("--defragment needs decrypted tracks, use convert instead of fetch")
+	}
+	if opts.selector.index < 0 {
+		return fmt.Errorf("--index must be a positive number")
+	}
+	if opts.selector.index > 0 && opts.selector.all {
+		return fmt.Errorf("--index and --all-playlists cannot be used together")
+	}
+	if opts.outputTemplate != "" {
+		if _, err := expandTemplate(opts.outputTemplate, nameFields{ext: opts.format}.placeholders()); err != nil {
+			return fmt.Errorf("--output-template: %v", err)
+		}
+	}
+	return nil
+}
+
+func cmdFetch(args []string) error {
+	fs := newFlagSet("fetch")
+	common := addCommonFlags(fs)
+	opts := convertOptions{format: "mp4"}
+	clip := addTrackFlags(fs, &opts)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if err := validateConvertOptions(opts); err != nil {
+		return withExit(exitUsage, err)
+	}
+	opts.clip, err = clip.timeRange()
+	if err != nil {
+		return withExit(exitUsage, err)
+	}
+
+	return runConvert(fs, common, nil, positional, opts)
+}
+
+func cmdKeys(args []string) error {
+	fs := newFlagSet("keys")
+	common := addCommonFlags(fs)
+	keys := addKeyFlags(fs)
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return withExit(exitUsage, errUsage)
+	}
+	input := positional[0]
+
+	keys.keystore = lookupKeystore(keys.keystore)
+	if err := common.apply(&input); err != nil {
+		return err
+	}
+
+	provider, err := keys.provider()
+	if err != nil {
+		return err
+	}
+
+	blurl, err := loadBLURL(input)
+	if err != nil {
+		return withExit(exitInput, fmt.Errorf("error parsing %s: %v", input, err))
+	}
+
+	if blurl.Ev == "" {
+		return withExit(exitKeyNotFound, fmt.Errorf("%s is not encrypted", input))
+	}
+
+	key, err := provider.Key(KeyRequest{EV: blurl.Ev})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(hex.EncodeToString(key))
+	return nil
+}
+
+func cmdInfo(args []string) error {
+	fs := newFlagSet("info")
+	common := addCommonFlags(fs)
+	var asJSON, offline bool
+	var keystore string
+	fs.BoolVar(&asJSON, "json", false, "print the details as JSON")
+	fs.BoolVar(&offline, "offline", false, "do not fetch the playlist manifests")
+	fs.StringVar(&keystore, "keys", "keys.bin", "keystore checked for the envelope's record")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		fs.Usage()
+		return withExit(exitUsage, errUsage)
+	}
+	input := positional[0]
+
+	keystore = lookupKeystore(keystore)
+	if err := common.apply(&input); err != nil {
+		return err
+	}
+
+	blurl, err := loadBLURL(input)
+	if err != nil {
+		return withExit(exitInput, fmt.Errorf("error parsing %s: %v", input, err))
+	}
+
+	info := describeBLURL(input, blurl, keystore, !offline)
+	if asJSON {
+		return writeInfoJSON(os.Stdout, info)
+	}
+	writeInfoText(os.Stdout, info)
+	return nil
+}
+
+func cmdPack(args []string) error {
+	fs := newFlagSet("pack")
+	common := addCommonFlags(fs)
+	var output string
+	fs.StringVar(&output, "o", "", "output .blurl file")
+	fs.StringVar(&output, "output", "", "output .blurl file")
+
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	input, output, err := inputAndOutput(fs, positional, output)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		output = strings.TrimSuffix(input, filepath.Ext(input)) + ".blurl"
+	}
+
+	if err := common.apply(&input, &output); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(input)
+	if err != nil {
+		return withExit(exitInput, err)
+	}
+
+	if detectInputKind(data) != inputJSON {
+		return withExit(exitInput, fmt.Errorf("%s is not a blurl JSON file", input))
+	}
+
+	var blurl BLURL
+	if err := json.Unmarshal(data, &blurl); err != nil {
+		return withExit(exitInput, fmt.Errorf("error decoding JSON: %v", err))
+	}
+
+	compact, err := json.Marshal(json.RawMessage(data))
+	if err != nil {
+		return withExit(exitInput, err)
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := packBLURL(f, compact); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,649 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type convertOptions struct {
+	output      string
+	selector    playlistSelector
+	keys        KeyProvider
+	format      string
+	concurrency int
+	jobs        int
+	decrypt     bool
+	tempDir     string
+	keepTemp    bool
+	defragment  bool
+	decoder     Decoder
+	stems       []stem
+	mix         map[string]float64
+	clip        timeRange
+	// outputTemplate names the outputs instead of the default names, see
+	// expandTemplate. force lets them replace existing files.
+	outputTemplate string
+	force          bool
+	// tags are added to the source tags of every output.
+	tags []tag
+	// reportKeys writes the content key into the reports.
+	reportKeys bool
+}
+
+// job is one input being converted. Batch runs give each job a name so that
+// logs, progress and outputs can be told apart.
+type job struct {
+	name      string
+	input     string
+	output    string
+	workspace string
+}
+
+func (j *job) ref(track string) trackRef {
+	return trackRef{Job: j.name, Track: track}
+}
+
+func convertFile(j *job, opts convertOptions) error {
+	log := j.ref("").logger()
+
+	blurl, err := loadBLURL(j.input)
+	if err != nil {
+		return withExit(exitInput, fmt.Errorf("error parsing %s: %v", j.input, err))
+	}
+
+	playlists, err := opts.selector.selectPlaylists(blurl)
+	if err != nil {
+		return err
+	}
+
+	// Previews are not encrypted, so a key is only needed for full songs. It is
+	// resolved once the first manifest shows what protects the tracks.
+	var key *contentKey
+	if opts.decrypt && len(blurl.Ev) > 0 && len(mainPlaylists(playlists)) > 0 {
+		key = &contentKey{ev: blurl.Ev, provider: opts.keys}
+	}
+
+	prefix := "blurlconvert-"
+	if j.name != "" {
+		prefix += j.name + "-"
+	}
+	j.workspace, err = os.MkdirTemp(opts.tempDir, prefix)
+	if err != nil {
+		return fmt.Errorf("error creating workspace: %v", err)
+	}
+	if opts.keepTemp {
+		defer log.Info("keeping workspace", "path", j.workspace)
+	} else {
+		defer os.RemoveAll(j.workspace)
+	}
+
+	if len(playlists) == 1 {
+		return convertPlaylist(j, playlists[0], key, opts, "", "")
+	}
+
+	var lastErr error
+	failed := 0
+	suffixes := playlistSuffixes(playlists)
+	templateSuffixes := templateSuffixes(opts.outputTemplate, j.input, playlists, opts.format, suffixes)
+	for i, suffix := range suffixes {
+		log.Info("converting playlist", "language", playlists[i].Language, "type", playlists[i].Type)
+
+		err := convertPlaylist(j, playlists[i], key, opts, suffix, templateSuffixes[i])
+		if err != nil {
+			log.Error("error converting playlist", "language", playlists[i].Language, "type", playlists[i].Type, "error", err)
+			lastErr = err
+			failed++
+		}
+	}
+
+	if failed > 0 && failed < len(playlists) {
+		return withExit(exitPartial, fmt.Errorf("%d of %d playlists failed: %w", failed, len(playlists), lastErr))
+	}
+	return lastErr
+}
+
+// convertPlaylist converts one playlist of a job. suffix tells its outputs and
+// workspace apart from those of the job's other playlists; templateSuffix does
+// the same for names from --output-template, which may need none.
+func convertPlaylist(j *job, playlist Playlist, key *contentKey, opts convertOptions, suffix, templateSuffix string) error {
+	ref := j.ref("")
+	log := ref.logger()
+	started := time.Now()
+	rec := startRecording(j.name)
+	defer rec.stop()
+
+	if playlist.URL == "" {
+		return withExit(exitInput, fmt.Errorf("playlist %s has no URL", describePlaylist(playlist)))
+	}
+
+	mediaurl, err := RemoveDuplicateUUIDPath(playlist.URL)
+	if err != nil {
+		return withExit(exitInput, fmt.Errorf("error processing URL %s: %v", mediaurl, err))
+	}
+
+	ref.report(ProgressEvent{Stage: stageManifest, Status: eventStart, URL: mediaurl})
+
+	mpddata, err := GetPlaylistMetadataByID(mediaurl)
+	if err != nil {
+		ref.reportError(stageManifest, err)
+		return withExit(exitNetwork, fmt.Errorf("error getting playlist metadata from %s: %v", mediaurl, err))
+	}
+
+	ref.report(ProgressEvent{Stage: stageManifest, Status: eventDone, URL: mediaurl})
+
+	kind := "master"
+	if playlist.isPreview() {
+		kind = "preview"
+		key = nil
+	}
+
+	tracks, err := planTracks(log, mpddata, mediaurl, opts.concurrency)
+	if err != nil {
+		return err
+	}
+	kids := defaultKIDs(mpddata)
+	var keyHex string
+	if key != nil {
+		k, err := key.resolve(ref, mpddata, tracks)
+		if err != nil {
+			return err
+		}
+		keyHex = hex.EncodeToString(k)
+		for i := range tracks {
+			tracks[i].Key = keyHex
+		}
+		if len(key.kids) > 0 {
+			kids = key.kids
+		}
+	}
+
+	// The playlist can be shorter than its media, previews in particular are
+	// cut from a longer file. The exported audio is trimmed to the playlist;
+	// mp4 output is clipped to it, which sets an edit list the same length.
+	var trim float64
+	clip := opts.clip
+	length := GetPlaylistDuration(mpddata)
+	if playlist.Duration > 0 && playlist.Duration < length {
+		length = playlist.Duration
+		switch {
+		case clip.set():
+			// A clip is cut from the playlist, so it ends with it too.
+			if clip.end == 0 || clip.end > length {
+				clip.end = length
+			}
+		case opts.format == "mp4" && !opts.decrypt && !playlist.isPreview():
+			log.Info("the playlist is shorter than its media, encrypted tracks keep the full media", "duration", length)
+		case opts.format == "mp4":
+			clip.end = length
+			log.Info("trimming to the playlist duration", "duration", length)
+		default:
+			trim = length
+			log.Info("trimming to the playlist duration", "duration", trim)
+		}
+	}
+	if opts.clip.set() {
+		if clip.start >= length {
+			return withExit(exitUsage, fmt.Errorf("--start %s is past the end of the song (%s)", formatTimestamp(clip.start), formatTimestamp(length)))
+		}
+		log.Info("clipping", "range", clip.String())
+	}
+
+	// Encrypted tracks cannot be cut between samples, so fetch keeps the whole
+	// segments that cover the clip.
+	cut := clip.set() && (opts.decrypt || playlist.isPreview())
+	if clip.set() && !cut {
+		log.Info("encrypted tracks are not cut, the output keeps the whole segments around the clip")
+	}
+
+	if opts.format != "mp4" {
+		tracks = audioTracks(log, tracks)
+		if len(tracks) == 0 {
+			return withExit(exitInput, fmt.Errorf("playlist has no audio track to export as %s", opts.format))
+		}
+	}
+
+	// Encrypted tracks are fetched as they are; only decrypted and preview
+	// tracks go through the muxer that writes tags.
+	var tags []tag
+	if opts.decrypt || playlist.isPreview() {
+		tags = withTags(sourceTags(j.input, playlist, playlistAssetID(playlist), length), opts.tags...)
+	} else if len(opts.tags) > 0 {
+		log.Info("encrypted tracks are not tagged")
+	}
+
+	merge := opts.decrypt && opts.format == "mp4" && canMerge(tracks)
+	out := outputPlan{
+		target:         j.output,
+		suffix:         suffix,
+		template:       opts.outputTemplate,
+		templateSuffix: templateSuffix,
+		kind:           kind,
+		tracks:         len(tracks),
+		fields:         playlistFields(j.input, playlist, opts.format),
+	}
+	if len(kids) > 0 {
+		out.fields.kid = kids[0].String()
+	}
+
+	mergedName := "preview.mp4"
+	if !playlist.isPreview() {
+		mergedName = masterName(mpddata)
+	}
+
+	// Every output is named before anything is downloaded, so clashes and
+	// existing files stop the run early.
+	var outputs []string
+	switch {
+	case merge:
+		outputs = append(outputs, out.mergedFile(mergedName, tracks))
+	case opts.stems != nil && opts.mix == nil:
+		for _, t := range tracks {
+			for _, s := range opts.stems {
+				outputs = append(outputs, out.trackFile(t, s.name))
+			}
+		}
+	default:
+		for _, t := range tracks {
+			outputs = append(outputs, out.trackFile(t, ""))
+		}
+	}
+	// Each output gets a report next to it, which must not clobber anything
+	// either.
+	for _, o := range outputs {
+		outputs = append(outputs, reportPath(o))
+	}
+	if err := checkOutputs(outputs, opts.force); err != nil {
+		return err
+	}
+
+	// Everything is built inside the job's workspace. Only finished files are
+	// moved to the output, so a failed run never leaves half-written media there.
+	workspace := j.workspace
+	if suffix != "" {
+		workspace = filepath.Join(workspace, suffix)
+	}
+
+	for i := range tracks {
+		tracks[i].Job = j.name
+		tracks[i].Duration = trim
+		tracks[i].Clip = clip
+		tracks[i].Tags = tags
+		tracks[i].Workspace = filepath.Join(workspace, tracks[i].Name)
+		tracks[i].OutputPath = filepath.Join(workspace, tracks[i].Name+".mp4")
+
+		if err := os.MkdirAll(tracks[i].Workspace, 0755); err != nil {
+			return fmt.Errorf("error creating workspace: %v", err)
+		}
+	}
+
+	report := conversionReport{
+		Playlist: reportPlaylist{
+			Language: playlist.Language,
+			Type:     out.fields.typ,
+			Duration: playlist.Duration,
+			URL:      playlist.URL,
+		},
+		ManifestURL: mediaurl,
+		KIDs:        kids,
+		Started:     started,
+	}
+	if report.Input, err = hashFile(j.input); err != nil {
+		return fmt.Errorf("error reading %s: %v", j.input, err)
+	}
+	if opts.reportKeys {
+		report.Key = keyHex
+	}
+	if opts.clip.set() {
+		report.Clip = clip.String()
+	}
+	for _, t := range tracks {
+		report.Tracks = append(report.Tracks, reportTrack{
+			Type:             t.MediaType,
+			RepresentationID: t.RepresentationID,
+			Codec:            t.Codec,
+			Bandwidth:        t.Bandwidth,
+			SampleRate:       t.SampleRate,
+			Channels:         t.Channels,
+			name:             t.Name,
+		})
+	}
+
+	// The length a downloaded track should have, for the report's warnings.
+	// Encrypted clips keep whole segments, so their length is not known.
+	expected := GetPlaylistDuration(mpddata)
+	switch {
+	case cut:
+		expected = clip.end - clip.start
+		if clip.end == 0 {
+			expected = length - clip.start
+		}
+	case clip.set():
+		expected = 0
+	}
+
+	var trackErr error
+	done := make([]bool, len(tracks))
+
+	for i := range tracks {
+		track := &tracks[i]
+		log.Info("processing track", "track", track.Name)
+
+		err := HandleDownloadTrack(track)
+		if err != nil {
+			j.ref(track.Name).reportError(stageDownload, err)
+			log.Error("error downloading track", "track", track.Name, "error", err)
+			trackErr = fmt.Errorf("error downloading %s track: %w", track.Name, err)
+			report.Tracks[i].Error = err.Error()
+			continue
+		}
+		if cut {
+			if err := clipTrack(*track, clip); err != nil {
+				log.Error("error clipping track", "track", track.Name, "error", err)
+				trackErr = err
+				report.Tracks[i].Error = err.Error()
+				continue
+			}
+		}
+		if err := checkTrack(j.ref(track.Name), track.OutputPath, expected); err != nil {
+			log.Debug("error checking track", "track", track.Name, "error", err)
+		}
+		done[i] = true
+	}
+
+	if err := os.MkdirAll(out.dir(), 0755); err != nil {
+		return fmt.Errorf("error creating output directory: %v", err)
+	}
+
+	if merge {
+		// Only the merged file was checked, so a failed track fails the
+		// playlist rather than leaving the other tracks on their own.
+		if trackErr != nil {
+			return trackErr
+		}
+
+		// Video goes first, as players expect.
+		var inputs []string
+		for _, video := range []bool{true, false} {
+			for _, track := range tracks {
+				if (track.MediaType == "video") == video {
+					inputs = append(inputs, track.OutputPath)
+				}
+			}
+		}
+
+		log.Info("merging tracks", "tracks", len(inputs))
+		final := out.mergedFile(mergedName, tracks)
+		merged := filepath.Join(workspace, "merged.mp4")
+		if err := Merge(ref, inputs, merged, opts.defragment, tags); err != nil {
+			return err
+		}
+		if err := publish(merged, final); err != nil {
+			return fmt.Errorf("error writing %s: %v", final, err)
+		}
+		if err := report.write(rec, []string{final}, nil); err != nil {
+			return err
+		}
+		log.Info("process completed successfully", "path", final)
+		return nil
+	}
+
+	var written []string
+
+	for i, track := range tracks {
+		if !done[i] {
+			continue
+		}
+		files, err := exportTrack(j.ref(track.Name), track, opts)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			final := out.trackFile(track, f.stem)
+			if err := publish(f.path, final); err != nil {
+				return fmt.Errorf("error writing %s: %v", final, err)
+			}
+			written = append(written, final)
+			log.Info("wrote track", "track", track.Name, "stem", f.stem, "path", final)
+		}
+	}
+
+	// Outputs of the tracks that did make it still get a report, which
+	// records the ones that failed.
+	if len(written) > 0 {
+		if err := report.write(rec, written, trackErr); err != nil {
+			return err
+		}
+	}
+	if trackErr != nil {
+		return trackErr
+	}
+
+	log.Info("process completed successfully")
+	return nil
+}
+
+func planTracks(log *slog.Logger, mpddata *MPD, mediaurl string, concurrency int) ([]TrackDownload, error) {
+	trackduration := GetPlaylistDuration(mpddata)
+	if trackduration <= 0 {
+		return nil, withExit(exitInput, fmt.Errorf("track duration %q is 0 or invalid", mpddata.MediaPresentationDuration))
+	}
+
+	if len(mpddata.Period.AdaptationSet) == 0 {
+		return nil, withExit(exitInput, fmt.Errorf("no AdaptationSet found in MPD"))
+	}
+
+	firstSet := mpddata.Period.AdaptationSet[0]
+	if len(firstSet.Representation) == 0 {
+		return nil, withExit(exitInput, fmt.Errorf("no Representation found in MPD"))
+	}
+
+	bestRepIndex := 0
+	bestBw := int64(-1)
+	for i, r := range firstSet.Representation {
+		bw, _ := strconv.ParseInt(r.Bandwidth, 10, 64)
+		if bw > bestBw {
+			bestBw = bw
+			bestRepIndex = i
+		}
+	}
+
+	segmentDurationStr := firstSet.Representation[bestRepIndex].SegmentTemplate.Duration
+	segmentTimescaleStr := firstSet.Representation[bestRepIndex].SegmentTemplate.Timescale
+
+	if segmentDurationStr == "" {
+		segmentDurationStr = firstSet.SegmentTemplate.Duration
+	}
+	if segmentTimescaleStr == "" {
+		segmentTimescaleStr = firstSet.SegmentTemplate.Timescale
+	}
+
+	segmentDuration, err := templateSegmentDuration(segmentDurationStr, segmentTimescaleStr)
+	if err != nil {
+		return nil, withExit(exitInput, err)
+	}
+	numberOfSegments := 1.0
+	if segmentDuration > 0 {
+		numberOfSegments = math.Ceil(trackduration / segmentDuration)
+	}
+
+	if numberOfSegments <= 0 {
+		return nil, withExit(exitInput, fmt.Errorf("invalid number of track segments: %v", numberOfSegments))
+	}
+
+	log.Info("selected representation",
+		"codec", firstSet.Representation[bestRepIndex].Codecs,
+		"sampling_rate", firstSet.Representation[bestRepIndex].AudioSamplingRate,
+		"bandwidth", firstSet.Representation[bestRepIndex].Bandwidth,
+		"segments", int(numberOfSegments))
+
+	var tracks []TrackDownload
+
+	for _, adaptation := range mpddata.Period.AdaptationSet {
+		if len(adaptation.Representation) == 0 {
+			return nil, withExit(exitInput, fmt.Errorf("adaptation set %q has no representations", adaptation.ID))
+		}
+
+		repIndex := 0
+		repBw := int64(-1)
+		for i, r := range adaptation.Representation {
+			bw, _ := strconv.ParseInt(r.Bandwidth, 10, 64)
+			if bw > repBw {
+				repBw = bw
+				repIndex = i
+			}
+		}
+
+		contentType := strings.TrimSpace(adaptation.ContentType)
+		if contentType == "" {
+			m := strings.ToLower(strings.TrimSpace(adaptation.Representation[repIndex].MimeType))
+			if strings.Contains(m, "audio/") {
+				contentType = "audio"
+			} else if strings.Contains(m, "video/") {
+				contentType = "video"
+			} else {
+				contentType = "audio"
+			}
+		}
+
+		initTpl := adaptation.Representation[repIndex].SegmentTemplate.Initialization
+		mediaTpl := adaptation.Representation[repIndex].SegmentTemplate.Media
+		startNumStr := adaptation.Representation[repIndex].SegmentTemplate.StartNumber
+
+		if initTpl == "" {
+			initTpl = adaptation.SegmentTemplate.Initialization
+		}
+		if mediaTpl == "" {
+			mediaTpl = adaptation.SegmentTemplate.Media
+		}
+		if startNumStr == "" {
+			startNumStr = adaptation.SegmentTemplate.StartNumber
+		}
+
+		startNumber := 1
+		if startNumStr != "" {
+			v, e := strconv.Atoi(startNumStr)
+			if e == nil && v > 0 {
+				startNumber = v
+			}
+		}
+
+		initFile := ""
+		if initTpl != "" {
+			initFile = strings.ReplaceAll(initTpl, "$RepresentationID$", adaptation.Representation[repIndex].ID)
+		} else {
+			initFile = strings.TrimSpace(adaptation.Representation[repIndex].BaseURL)
+		}
+
+		fullFileURL := ""
+		initRange := ""
+		indexRange := ""
+
+		if mediaTpl == "" {
+			baseName := strings.TrimSpace(adaptation.Representation[repIndex].BaseURL)
+			if baseName != "" {
+				fullFileURL = getBaseURL(mediaurl) + baseName
+				initRange = adaptation.Representation[repIndex].SegmentBase.Initialization.Range
+				indexRange = adaptation.Representation[repIndex].SegmentBase.IndexRange
+			}
+		}
+
+		sampleRate, _ := strconv.Atoi(adaptation.Representation[repIndex].AudioSamplingRate)
+		channels := parseChannelCount(adaptation.Representation[repIndex].AudioChannelConfiguration.SchemeIdUri, adaptation.Representation[repIndex].AudioChannelConfiguration.Value)
+
+		tracks = append(tracks, TrackDownload{
+			MediaType:        contentType,
+			Segments:         int(numberOfSegments),
+			SegmentDuration:  segmentDuration,
+			BaseURL:          getBaseURL(mediaurl),
+			InitFile:         initFile,
+			RepresentationID: adaptation.Representation[repIndex].ID,
+			MediaTemplate:    mediaTpl,
+			StartNumber:      startNumber,
+			FullFileURL:      fullFileURL,
+			InitRange:        initRange,
+			IndexRange:       indexRange,
+			Concurrency:      concurrency,
+			SampleRate:       sampleRate,
+			Codec:            adaptation.Representation[repIndex].Codecs,
+			Bandwidth:        repBw,
+			Channels:         channels,
+		})
+	}
+	nameTracks(tracks)
+
+	return tracks, nil
+}
+
+// nameTracks names each track after its media type. When several adaptation
+// sets have the same type, the index of the set is added so that their
+// workspaces and outputs do not overwrite each other.
+func nameTracks(tracks []TrackDownload) {
+	count := make(map[string]int)
+	for _, t := range tracks {
+		count[t.MediaType]++
+	}
+	for i := range tracks {
+		tracks[i].Name = tracks[i].MediaType
+		if count[tracks[i].MediaType] > 1 {
+			tracks[i].Name = fmt.Sprintf("%s_%d", tracks[i].MediaType, i)
+		}
+	}
+}
+
+// templateSegments is the number of segments a SegmentTemplate addresses, or 1
+// when the template has no segment duration.
+func templateSegments(trackduration float64, durationStr, timescaleStr string) (float64, error) {
+	segmentDuration, err := templateSegmentDuration(durationStr, timescaleStr)
+	if err != nil || segmentDuration == 0 {
+		return 1, err
+	}
+	return math.Ceil(trackduration / segmentDuration), nil
+}
+
+// templateSegmentDuration is the length in seconds of each segment of a
+// SegmentTemplate, or 0 when the template gives none.
+func templateSegmentDuration(durationStr, timescaleStr string) (float64, error) {
+	if durationStr == "" || timescaleStr == "" {
+		return 0, nil
+	}
+
+	segmentDuration, err := strconv.ParseInt(durationStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing segment duration %q: %v", durationStr, err)
+	}
+
+	timescale, err := strconv.ParseInt(timescaleStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing timescale %q: %v", timescaleStr, err)
+	}
+	if segmentDuration <= 0 || timescale <= 0 {
+		return 0, fmt.Errorf("invalid segment duration %s/%s", durationStr, timescaleStr)
+	}
+
+	return float64(segmentDuration) / float64(timescale), nil
+}
+
+// parseChannelCount reads AudioChannelConfiguration, which is either a plain
+// channel count or a CICP layout index. It returns 0 when it cannot tell.
+func parseChannelCount(scheme, value string) int {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if strings.Contains(strings.ToLower(scheme), "cicp") {
+		cicp := map[int]int{1: 1, 2: 2, 3: 3, 4: 4, 5: 5, 6: 6, 7: 8, 9: 3, 10: 4, 11: 7, 12: 8, 14: 8}
+		return cicp[n]
+	}
+	return n
+}
+
+func canMerge(tracks []TrackDownload) bool {
+	return len(tracks) > 1
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+const twoAudioSetsMPD = `<MPD mediaPresentationDuration="PT10S">
+  <Period>
+    <AdaptationSet id="0" contentType="audio">
+      <SegmentTemplate duration="4" timescale="1" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number$.m4s"/>
+      <Representation id="stems" bandwidth="512000" audioSamplingRate="48000" codecs="mp4a.40.2"/>
+    </AdaptationSet>
+    <AdaptationSet id="1" contentType="audio">
+      <SegmentTemplate duration="4" timescale="1" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number$.m4s"/>
+      <Representation id="mix" bandwidth="128000" audioSamplingRate="48000" codecs="mp4a.40.2"/>
+    </AdaptationSet>
+    <AdaptationSet id="2" contentType="video">
+      <SegmentTemplate duration="4" timescale="1" initialization="$RepresentationID$/init.mp4" media="$RepresentationID$/$Number$.m4s"/>
+      <Representation id="video" bandwidth="1000000" mimeType="video/mp4"/>
+    </AdaptationSet>
+  </Period>
+</MPD>`
+
+func TestTwoAudioSetsKeepTheirOutputs(t *testing.T) {
+	var mpd MPD
+	if err := xml.Unmarshal([]byte(twoAudioSetsMPD), &mpd); err != nil {
+		t.Fatal(err)
+	}
+	tracks, err := planTracks(slog.New(slog.NewTextHandler(io.Discard, nil)), &mpd, "http://example.com/song.mpd", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+	for _, track := range tracks {
+		names = append(names, track.Name)
+	}
+	if len(names) != 3 || names[0] != "audio_0" || names[1] != "audio_1" || names[2] != "video" {
+		t.Fatalf("tracks are named %q, want audio_0, audio_1 and video", names)
+	}
+
+	out := outputPlan{target: "out/", kind: "master", tracks: len(tracks), fields: nameFields{ext: "mp4"}}
+	var outputs []string
+	for _, track := range tracks {
+		outputs = append(outputs, out.trackFile(track, ""), out.trackFile(track, "vocals"))
+	}
+	if err := checkOutputs(outputs, true); err != nil {
+		t.Errorf("outputs %q: %v", outputs, err)
+	}
+	if got := out.trackFile(tracks[1], ""); got != "out/master_audio_1.mp4" {
+		t.Errorf("second audio set is written to %s", got)
+	}
+}
+
+func TestNameTracksKeepsSingleTypes(t *testing.T) {
+	tracks := []TrackDownload{{MediaType: "video"}, {MediaType: "audio"}}
+	nameTracks(tracks)
+	if tracks[0].Name != "video" || tracks[1].Name != "audio" {
+		t.Errorf("tracks are named %q and %q", tracks[0].Name, tracks[1].Name)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// pcmFormat describes interleaved signed 16-bit little-endian PCM.
+type pcmFormat struct {
+	sampleRate int
+	channels   int
+}
+
+const pcmBitsPerSample = 16
+
+func (f pcmFormat) frameSize() int {
+	return f.channels * pcmBitsPerSample / 8
+}
+
+// Decoder turns an encoded audio track into PCM in the requested format.
+type Decoder interface {
+	Name() string
+	Decode(src string, format pcmFormat) (io.ReadCloser, error)
+}
+
+func newDecoder(name string) (Decoder, error) {
+	switch name {
+	case "ffmpeg":
+		return ffmpegDecoder{path: "ffmpeg"}, nil
+	}
+	return nil, fmt.Errorf("unknown decoder %q", name)
+}
+
+// ffmpegDecoder runs ffmpeg and streams the decoded PCM over a pipe.
+type ffmpegDecoder struct {
+	path string
+}
+
+func (d ffmpegDecoder) Name() string {
+	return "ffmpeg"
+}
+
+func (d ffmpegDecoder) Decode(src string, format pcmFormat) (io.ReadCloser, error) {
+	cmd := exec.Command(d.path,
+		"-v", "error",
+		"-i", src,
+		"-map", "0:a:0",
+		"-f", "s16le",
+		"-acodec", "pcm_s16le",
+		"-ar", strconv.Itoa(format.sampleRate),
+		"-ac", strconv.Itoa(format.channels),
+		"-")
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p := &ffmpegPipe{ReadCloser: stdout, cmd: cmd}
+	cmd.Stderr = &p.stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting ffmpeg: %v", err)
+	}
+	return p, nil
+}
+
+// trimPCM ends a PCM stream after the given number of seconds. The rest of
+// the stream is still read, so that the decoder can exit normally.
+func trimPCM(pcm io.Reader, format pcmFormat, seconds float64) io.Reader {
+	if seconds <= 0 {
+		return pcm
+	}
+	frames := int64(math.Round(seconds * float64(format.sampleRate)))
+	return &trimmedPCM{r: pcm, left: frames * int64(format.frameSize())}
+}
+
+type trimmedPCM struct {
+	r    io.Reader
+	left int64
+}
+
+func (t *trimmedPCM) Read(p []byte) (int, error) {
+	if t.left <= 0 {
+		if _, err := io.Copy(io.Discard, t.r); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > t.left {
+		p = p[:t.left]
+	}
+	n, err := t.r.Read(p)
+	t.left -= int64(n)
+	return n, err
+}
+
+type ffmpegPipe struct {
+	io.ReadCloser
+	cmd    *exec.Cmd
+	stderr bytes.Buffer
+}
+
+// Close waits for ffmpeg so that a failed decode is not mistaken for the end
+// of the stream.
+func (p *ffmpegPipe) Close() error {
+	p.ReadCloser.Close()
+	if err := p.cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+			return fmt.Errorf("ffmpeg decode: %v: %s", err, msg)
+		}
+		return fmt.Errorf("ffmpeg decode: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+)
+
+// Process exit codes. They are part of the command line interface, keep them stable.
+const (
+	exitOK          = 0
+	exitFailure     = 1
+	exitUsage       = 2
+	exitInput       = 3
+	exitKeyNotFound = 4
+	exitNetwork     = 5
+	exitDecrypt     = 6
+	exitMux         = 7
+	exitPartial     = 8
+)
+
+var errUsage = errors.New("invalid usage")
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func withExit(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return ee.code
+	}
+	return exitFailure
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// audioTracks drops the tracks an audio-only format cannot hold.
+func audioTracks(log *slog.Logger, tracks []TrackDownload) []TrackDownload {
+	var audio []TrackDownload
+	for _, t := range tracks {
+		if t.MediaType != "audio" {
+			log.Info("skipping track, the output format is audio only", "track", t.MediaType)
+			continue
+		}
+		audio = append(audio, t)
+	}
+	return audio
+}
+
+// exportedFile is one file made from a track, waiting in the workspace to be
+// published. Stems carry their name so that outputs can be told apart.
+type exportedFile struct {
+	path string
+	stem string
+}
+
+// exportTrack converts a finished track into the requested format inside the
+// workspace and returns the files to publish.
+func exportTrack(ref trackRef, track TrackDownload, opts convertOptions) ([]exportedFile, error) {
+	if opts.format == "mp4" && !opts.defragment && len(track.Tags) == 0 {
+		return []exportedFile{{path: track.OutputPath}}, nil
+	}
+
+	base := strings.TrimSuffix(track.OutputPath, filepath.Ext(track.OutputPath))
+	dst := base + "." + opts.format
+	if opts.format == "mp4" {
+		dst = base + "_export.mp4"
+	}
+	files := []exportedFile{{path: dst}}
+	ref.report(ProgressEvent{Stage: stageExport, Status: eventStart})
+
+	var err error
+	switch {
+	case opts.format == "mp4":
+		err = writeMP4([]string{track.OutputPath}, dst, opts.defragment, track.Tags)
+	case opts.mix != nil:
+		err = mixStems(ref, track, opts, dst)
+	case opts.stems != nil:
+		files, err = splitStems(ref, track, opts)
+	case opts.format == "opus":
+		err = remuxOpus(track.OutputPath, dst, track.Duration, track.Tags)
+	case opts.format == "wav" || opts.format == "flac":
+		var write pcmWriter
+		if write, err = pcmWriterFor(opts.format, track.Tags); err == nil {
+			err = decodeTo(ref, track, opts.decoder, dst, write)
+		}
+	default:
+		err = fmt.Errorf("unknown format %q", opts.format)
+	}
+	if err != nil {
+		ref.reportError(stageExport, err)
+		return nil, withExit(exitMux, fmt.Errorf("error exporting %s track as %s: %v", track.MediaType, opts.format, err))
+	}
+
+	ref.report(ProgressEvent{Stage: stageExport, Status: eventDone})
+	return files, nil
+}
+
+// pcmWriter writes a PCM stream into a file of one of the PCM formats.
+type pcmWriter func(dst string, format pcmFormat, pcm io.Reader) error
+
+// pcmWriterFor picks the writer of a PCM format. WAV files carry no tags.
+func pcmWriterFor(format string, tags []tag) (pcmWriter, error) {
+	switch format {
+	case "wav":
+		return writeWAV, nil
+	case "flac":
+		return func(dst string, format pcmFormat, pcm io.Reader) error {
+			return writeFLAC(dst, format, tags, pcm)
+		}, nil
+	}
+	return nil, fmt.Errorf("%s is not a PCM format", format)
+}
+
+// trackPCMFormat is the sampling rate and channel count the manifest gives for
+// a track, with fallbacks when it gives none.
+func trackPCMFormat(ref trackRef, track TrackDownload) pcmFormat {
+	format := pcmFormat{sampleRate: track.SampleRate, channels: track.Channels}
+	if format.sampleRate <= 0 {
+		format.sampleRate = 48000
+		ref.logger().Warn("manifest has no sampling rate, decoding at 48000 Hz")
+	}
+	if format.channels <= 0 {
+		format.channels = 2
+		ref.logger().Warn("manifest has no channel configuration, decoding to stereo")
+	}
+	return format
+}
+
+// decodeTo decodes a track and hands the PCM to write.
+func decodeTo(ref trackRef, track TrackDownload, decoder Decoder, dst string, write pcmWriter) error {
+	format := trackPCMFormat(ref, track)
+
+	ref.logger().Debug("decoding track", "decoder", decoder.Name(), "sampling_rate", format.sampleRate, "channels", format.channels)
+
+	pcm, err := decoder.Decode(track.OutputPath, format)
+	if err != nil {
+		return err
+	}
+	err = write(dst, format, trimPCM(pcm, format, track.Duration))
+	if closeErr := pcm.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
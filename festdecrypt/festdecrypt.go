@@ -94,36 +94,53 @@ func addBase64Padding(b64blob []byte) string {
 	return string(b64blob)
 }
 
-func GetFestEncryptionKey(EVString string, Bearer string) (string, error) {
+// FestKey is one content key of an envelope: its kid as written in the
+// envelope (base64url) and the key as hex.
+type FestKey struct {
+	KID string
+	Key string
+}
+
+func GetFestEncryptionKeys(EVString string, Bearer string) ([]FestKey, error) {
 	var cdmobj CDMJson
 
 	strevobj, err := decryptEnvelope(EVString, Bearer)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	err = json.Unmarshal([]byte(strevobj), &cdmobj)
 
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if len(cdmobj.Keys) == 0 {
-		return "", errors.New("no keys found in ev blob")
+		return nil, errors.New("no keys found in ev blob")
 	}
 
-	key := cdmobj.Keys[0].K
+	var keys []FestKey
+	for _, k := range cdmobj.Keys {
+		key := strings.ReplaceAll(k.K, "-", "+")
+		key = strings.ReplaceAll(key, "_", "/")
 
-	key = strings.ReplaceAll(key, "-", "+")
-	key = strings.ReplaceAll(key, "_", "/")
+		decodedKey, err := base64.StdEncoding.DecodeString(addBase64Padding([]byte(key)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key %v", err)
+		}
 
-	decodedKey, err := base64.StdEncoding.DecodeString(addBase64Padding([]byte(key)))
-	if err != nil {
-		return "", fmt.Errorf("failed to decode key %v", err)
+		keys = append(keys, FestKey{KID: k.Kid, Key: hex.EncodeToString(decodedKey)})
 	}
 
-	key = hex.EncodeToString(decodedKey)
+	return keys, nil
+}
+
+func GetFestEncryptionKey(EVString string, Bearer string) (string, error) {
+	keys, err := GetFestEncryptionKeys(EVString, Bearer)
+	if err != nil {
+		return "", err
+	}
 
-	return key, nil
+	return keys[0].Key, nil
 }
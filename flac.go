@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+)
+
+// FLAC encoding with the fixed predictors and partitioned Rice coding. That
+// is what the reference encoder does at its lowest levels, and it keeps the
+// output lossless and decodable by every FLAC reader.
+const (
+	flacBlockSize         = 4096
+	flacMaxChannels       = 8
+	flacMaxPartitionOrder = 8
+	flacMaxRiceParam      = 14
+	flacStreamInfoSize    = 34
+)
+
+const (
+	subframeConstant = iota
+	subframeVerbatim
+	subframeFixed
+)
+
+const (
+	channelsIndependent = -1
+	channelsLeftSide    = 8
+	channelsRightSide   = 9
+	channelsMidSide     = 10
+)
+
+// writeFLAC encodes PCM into a FLAC file. STREAMINFO holds totals that are
+// only known at the end, so it is patched in once all frames are written.
+func writeFLAC(dst string, format pcmFormat, tags []tag, pcm io.Reader) error {
+	if format.channels < 1 || format.channels > flacMaxChannels {
+		return fmt.Errorf("FLAC supports 1 to %d channels, the track has %d", flacMaxChannels, format.channels)
+	}
+	if format.sampleRate <= 0 || format.sampleRate >= 1<<20 {
+		return fmt.Errorf("FLAC cannot store a sampling rate of %d Hz", format.sampleRate)
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	e := &flacEncoder{format: format, md5: md5.New(), comments: len(tags) > 0}
+	if _, err := f.Write(e.header()); err != nil {
+		return err
+	}
+	if e.comments {
+		if _, err := f.Write(flacCommentBlock(tags)); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(f)
+	frameSize := format.frameSize()
+	block := make([]byte, flacBlockSize*frameSize)
+	channels := make([][]int32, format.channels)
+	for c := range channels {
+		channels[c] = make([]int32, flacBlockSize)
+	}
+
+	for {
+		n, err := io.ReadFull(pcm, block)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n%frameSize != 0 {
+			return fmt.Errorf("decoder returned a partial frame of %d bytes", n%frameSize)
+		}
+
+		e.md5.Write(block[:n])
+		samples := n / frameSize
+		for i := 0; i < samples; i++ {
+			for c := range channels {
+				channels[c][i] = int32(int16(binary.LittleEndian.Uint16(block[(i*format.channels+c)*2:])))
+			}
+		}
+
+		frame := make([][]int32, format.channels)
+		for c := range channels {
+			frame[c] = channels[c][:samples]
+		}
+		if _, err := w.Write(e.encodeFrame(frame)); err != nil {
+			return err
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(e.header(), 0); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+type flacEncoder struct {
+	format   pcmFormat
+	comments bool
+	frames   uint64
+	samples  uint64
+	minFrame int
+	maxFrame int
+	md5      hash.Hash
+}
+
+// header is the "fLaC" marker followed by the STREAMINFO block, which is the
+// last metadata block unless a VORBIS_COMMENT block follows.
+func (e *flacEncoder) header() []byte {
+	last := uint64(1)
+	if e.comments {
+		last = 0
+	}
+
+	var w bitWriter
+	w.write(0x664c6143, 32) // "fLaC"
+	w.write(last, 1)        // last metadata block
+	w.write(0, 7)           // STREAMINFO
+	w.write(flacStreamInfoSize, 24)
+
+	w.write(flacBlockSize, 16)
+	w.write(flacBlockSize, 16)
+	w.write(uint64(e.minFrame), 24)
+	w.write(uint64(e.maxFrame), 24)
+	w.write(uint64(e.format.sampleRate), 20)
+	w.write(uint64(e.format.channels-1), 3)
+	w.write(pcmBitsPerSample-1, 5)
+	w.write(e.samples>>32, 4)
+	w.write(e.samples&0xffffffff, 32)
+
+	b := w.bytes()
+	var sum [16]byte
+	if e.samples > 0 {
+		copy(sum[:], e.md5.Sum(nil))
+	}
+	return append(b, sum[:]...)
+}
+
+// flacCommentBlock is the last metadata block, a VORBIS_COMMENT holding tags.
+func flacCommentBlock(tags []tag) []byte {
+	comments := vorbisComments(tags)
+	b := []byte{0x80 | 4}
+	b = append(b, byte(len(comments)>>16), byte(len(comments)>>8), byte(len(comments)))
+	return append(b, comments...)
+}
+
+func (e *flacEncoder) encodeFrame(channels [][]int32) []byte {
+	n := len(channels[0])
+
+	subframes := make([]subframe, len(channels))
+	assignment := channelsIndependent
+
+	if len(channels) == 2 {
+		left, right := channels[0], channels[1]
+		side := make([]int32, n)
+		mid := make([]int32, n)
+		for i := range left {
+			side[i] = left[i] - right[i]
+			mid[i] = (left[i] + right[i]) >> 1
+		}
+
+		l := planSubframe(left, pcmBitsPerSample)
+		r := planSubframe(right, pcmBitsPerSample)
+		s := planSubframe(side, pcmBitsPerSample+1)
+		m := planSubframe(mid, pcmBitsPerSample)
+
+		subframes[0], subframes[1] = l, r
+		best := l.bits + r.bits
+		if l.bits+s.bits < best {
+			assignment, best = channelsLeftSide, l.bits+s.bits
+			subframes[0], subframes[1] = l, s
+		}
+		if s.bits+r.bits < best {
+			assignment, best = channelsRightSide, s.bits+r.bits
+			subframes[0], subframes[1] = s, r
+		}
+		if m.bits+s.bits < best {
+			assignment = channelsMidSide
+			subframes[0], subframes[1] = m, s
+		}
+	} else {
+		for c := range channels {
+			subframes[c] = planSubframe(channels[c], pcmBitsPerSample)
+		}
+	}
+	if assignment == channelsIndependent {
+		assignment = len(channels) - 1
+	}
+
+	var w bitWriter
+	w.write(0xfff8, 16) // sync code, fixed block size
+	if n == flacBlockSize {
+		w.write(12, 4)
+	} else {
+		w.write(7, 4)
+	}
+	w.write(0, 4) // sampling rate from STREAMINFO
+	w.write(uint64(assignment), 4)
+	w.write(4, 3) // 16 bits per sample
+	w.write(0, 1)
+	w.writeUTF8(e.frames)
+	if n != flacBlockSize {
+		w.write(uint64(n-1), 16)
+	}
+	w.write(uint64(crc8(w.bytes())), 8)
+
+	for _, sf := range subframes {
+		sf.write(&w)
+	}
+	w.align()
+
+	frame := w.bytes()
+	frame = binary.BigEndian.AppendUint16(frame, crc16(frame))
+
+	e.frames++
+	e.samples += uint64(n)
+	if e.minFrame == 0 || len(frame) < e.minFrame {
+		e.minFrame = len(frame)
+	}
+	if len(frame) > e.maxFrame {
+		e.maxFrame = len(frame)
+	}
+	return frame
+}
+
+// subframe is the cheapest encoding found for one channel of a block.
+type subframe struct {
+	kind      int
+	order     int
+	bps       uint
+	samples   []int32
+	residual  []uint64
+	partOrder int
+	params    []int
+	bits      int
+}
+
+func planSubframe(x []int32, bps uint) subframe {
+	n := len(x)
+
+	constant := true
+	for _, v := range x[1:] {
+		if v != x[0] {
+			constant = false
+			break
+		}
+	}
+	if constant {
+		return subframe{kind: subframeConstant, bps: bps, samples: x, bits: 8 + int(bps)}
+	}
+
+	best := subframe{kind: subframeVerbatim, bps: bps, samples: x, bits: 8 + n*int(bps)}
+	for order := 0; order <= 4 && order < n; order++ {
+		residual := fixedResidual(x, order)
+		partOrder, params, bits := planRice(residual, n, order)
+		bits += 8 + order*int(bps) + 6
+		if bits < best.bits {
+			best = subframe{
+				kind:      subframeFixed,
+				order:     order,
+				bps:       bps,
+				samples:   x,
+				residual:  residual,
+				partOrder: partOrder,
+				params:    params,
+				bits:      bits,
+			}
+		}
+	}
+	return best
+}
+
+// fixedResidual applies the fixed predictor of the given order and returns
+// the zigzag-folded residuals after the warm-up samples.
+func fixedResidual(x []int32, order int) []uint64 {
+	residual := make([]uint64, 0, len(x)-order)
+	for i := order; i < len(x); i++ {
+		var r int64
+		switch order {
+		case 0:
+			r = int64(x[i])
+		case 1:
+			r = int64(x[i]) - int64(x[i-1])
+		case 2:
+			r = int64(x[i]) - 2*int64(x[i-1]) + int64(x[i-2])
+		case 3:
+			r = int64(x[i]) - 3*int64(x[i-1]) + 3*int64(x[i-2]) - int64(x[i-3])
+		case 4:
+			r = int64(x[i]) - 4*int64(x[i-1]) + 6*int64(x[i-2]) - 4*int64(x[i-3]) + int64(x[i-4])
+		}
+		residual = append(residual, uint64(r<<1)^uint64(r>>63))
+	}
+	return residual
+}
+
+// planRice picks the partition order and per-partition Rice parameters with
+// the smallest estimated size.
+func planRice(residual []uint64, n, order int) (int, []int, int) {
+	maxOrder := 0
+	for p := 1; p <= flacMaxPartitionOrder; p++ {
+		if n%(1<<p) != 0 || n>>p <= order {
+			break
+		}
+		maxOrder = p
+	}
+
+	// Sums of the finest partitions, merged pairwise for lower orders.
+	parts := 1 << maxOrder
+	sums := make([]uint64, parts)
+	counts := make([]int, parts)
+	i := 0
+	for p := 0; p < parts; p++ {
+		count := n >> maxOrder
+		if p == 0 {
+			count -= order
+		}
+		for j := 0; j < count; j++ {
+			sums[p] += residual[i]
+			i++
+		}
+		counts[p] = count
+	}
+
+	bestOrder, bestBits := 0, -1
+	var bestParams []int
+	for p := maxOrder; p >= 0; p-- {
+		params := make([]int, len(sums))
+		bits := 0
+		for k := range sums {
+			params[k], bits = riceParam(sums[k], counts[k]), bits+4
+			bits += riceBits(sums[k], counts[k], params[k])
+		}
+		if bestBits < 0 || bits < bestBits {
+			bestOrder, bestBits, bestParams = p, bits, params
+		}
+
+		if p > 0 {
+			merged := make([]uint64, len(sums)/2)
+			mergedCounts := make([]int, len(sums)/2)
+			for k := range merged {
+				merged[k] = sums[2*k] + sums[2*k+1]
+				mergedCounts[k] = counts[2*k] + counts[2*k+1]
+			}
+			sums, counts = merged, mergedCounts
+		}
+	}
+	return bestOrder, bestParams, bestBits
+}
+
+func riceParam(sum uint64, count int) int {
+	best, bestBits := 0, -1
+	for k := 0; k <= flacMaxRiceParam; k++ {
+		bits := riceBits(sum, count, k)
+		if bestBits < 0 || bits < bestBits {
+			best, bestBits = k, bits
+		}
+	}
+	return best
+}
+
+// riceBits estimates the size of count values summing to sum with parameter k.
+func riceBits(sum uint64, count, k int) int {
+	return count*(k+1) + int(sum>>k)
+}
+
+func (sf subframe) write(w *bitWriter) {
+	switch sf.kind {
+	case subframeConstant:
+		w.write(0, 8)
+		w.writeSigned(int64(sf.samples[0]), sf.bps)
+	case subframeVerbatim:
+		w.write(1<<1, 8)
+		for _, v := range sf.samples {
+			w.writeSigned(int64(v), sf.bps)
+		}
+	case subframeFixed:
+		w.write(uint64(0x08|sf.order)<<1, 8)
+		for _, v := range sf.samples[:sf.order] {
+			w.writeSigned(int64(v), sf.bps)
+		}
+		w.write(0, 2) // Rice coding with 4-bit parameters
+		w.write(uint64(sf.partOrder), 4)
+
+		n := len(sf.samples)
+		i := 0
+		for p, k := range sf.params {
+			count := n >> sf.partOrder
+			if p == 0 {
+				count -= sf.order
+			}
+			w.write(uint64(k), 4)
+			for _, u := range sf.residual[i : i+count] {
+				w.writeUnary(u >> k)
+				w.write(u&(1<<k-1), uint(k))
+			}
+			i += count
+		}
+	}
+}
+
+// bitWriter packs values most significant bit first.
+type bitWriter struct {
+	buf []byte
+	acc uint64
+	n   uint
+}
+
+func (w *bitWriter) write(v uint64, bits uint) {
+	for bits > 32 {
+		w.write(v>>32, bits-32)
+		v &= 0xffffffff
+		bits = 32
+	}
+	w.acc = w.acc<<bits | v&(1<<bits-1)
+	w.n += bits
+	for w.n >= 8 {
+		w.buf = append(w.buf, byte(w.acc>>(w.n-8)))
+		w.n -= 8
+	}
+}
+
+func (w *bitWriter) writeSigned(v int64, bits uint) {
+	w.write(uint64(v)&(1<<bits-1), bits)
+}
+
+func (w *bitWriter) writeUnary(q uint64) {
+	for ; q >= 32; q -= 32 {
+		w.write(0, 32)
+	}
+	w.write(1, uint(q)+1)
+}
+
+// writeUTF8 writes a frame number in FLAC's extended UTF-8 coding.
+func (w *bitWriter) writeUTF8(v uint64) {
+	if v < 0x80 {
+		w.write(v, 8)
+		return
+	}
+	extra := 1
+	for v >= 1<<(5*extra+6) && extra < 6 {
+		extra++
+	}
+	lead := uint64(0xff<<(7-extra)) & 0xff
+	w.write(lead|v>>(6*extra), 8)
+	for i := extra - 1; i >= 0; i-- {
+		w.write(0x80|(v>>(6*i))&0x3f, 8)
+	}
+}
+
+func (w *bitWriter) align() {
+	if w.n > 0 {
+		w.write(0, 8-w.n)
+	}
+}
+
+// bytes returns the complete bytes written so far.
+func (w *bitWriter) bytes() []byte {
+	return w.buf
+}
+
+func crc8(b []byte) uint8 {
+	var crc uint8
+	for _, c := range b {
+		crc ^= c
+		for i := 0; i < 8; i++ {
+			if crc&0x80 != 0 {
+				crc = crc<<1 ^ 0x07
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+func crc16(b []byte) uint16 {
+	var crc uint16
+	for _, c := range b {
+		crc ^= uint16(c) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x8005
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
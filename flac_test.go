@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// flacTestReader reads bits most significant first, as FLAC stores them.
+type flacTestReader struct {
+	buf []byte
+	pos uint // in bits
+}
+
+func (r *flacTestReader) read(bits uint) uint64 {
+	var v uint64
+	for i := uint(0); i < bits; i++ {
+		if r.pos/8 >= uint(len(r.buf)) {
+			panic("read past the end of the file")
+		}
+		v = v<<1 | uint64(r.buf[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *flacTestReader) readSigned(bits uint) int64 {
+	v := r.read(bits)
+	return int64(v<<(64-bits)) >> (64 - bits)
+}
+
+func (r *flacTestReader) readUnary() uint64 {
+	var q uint64
+	for r.read(1) == 0 {
+		q++
+	}
+	return q
+}
+
+func (r *flacTestReader) readUTF8() uint64 {
+	first := r.read(8)
+	if first < 0x80 {
+		return first
+	}
+	extra := 0
+	for first&(0x80>>(extra+1)) != 0 {
+		extra++
+	}
+	v := first & (0x3f >> extra)
+	for i := 0; i < extra; i++ {
+		v = v<<6 | r.read(8)&0x3f
+	}
+	return v
+}
+
+func (r *flacTestReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+// flacTestStream is what the test decoder reads from a FLAC file.
+type flacTestStream struct {
+	sampleRate int
+	channels   int
+	samples    uint64
+	md5        [16]byte
+	// comments is the body of the VORBIS_COMMENT block, if there is one.
+	comments []byte
+	// pcm is the decoded audio as interleaved 16-bit little endian samples.
+	pcm []byte
+}
+
+// decodeFLACTest decodes the subset of FLAC that writeFLAC produces and
+// checks the CRCs and frame numbers on the way.
+func decodeFLACTest(t *testing.T, b []byte) flacTestStream {
+	t.Helper()
+	if string(b[:4]) != "fLaC" {
+		t.Fatal("no fLaC marker")
+	}
+	r := &flacTestReader{buf: b, pos: 32}
+
+	var s flacTestStream
+	for last := false; !last; {
+		last = r.read(1) == 1
+		typ := r.read(7)
+		size := uint(r.read(24))
+		start := r.pos
+		if typ == 0 {
+			r.read(16 + 16 + 24 + 24)
+			s.sampleRate = int(r.read(20))
+			s.channels = int(r.read(3)) + 1
+			if bps := r.read(5) + 1; bps != 16 {
+				t.Fatalf("STREAMINFO has %d bits per sample", bps)
+			}
+			s.samples = r.read(36)
+			copy(s.md5[:], b[r.pos/8:r.pos/8+16])
+		}
+		if typ == 4 {
+			s.comments = b[start/8 : start/8+size]
+		}
+		r.pos = start + size*8
+	}
+
+	for frame := uint64(0); r.pos/8 < uint(len(b)); frame++ {
+		start := r.pos / 8
+		if sync := r.read(16); sync != 0xfff8 {
+			t.Fatalf("frame %d: sync code %#x", frame, sync)
+		}
+		blockCode := r.read(4)
+		if rate := r.read(4); rate != 0 {
+			t.Fatalf("frame %d: sampling rate code %d", frame, rate)
+		}
+		assignment := int(r.read(4))
+		if bps := r.read(3); bps != 4 {
+			t.Fatalf("frame %d: sample size code %d", frame, bps)
+		}
+		r.read(1)
+		if n := r.readUTF8(); n != frame {
+			t.Fatalf("frame %d: header says frame %d", frame, n)
+		}
+		n := flacBlockSize
+		switch blockCode {
+		case 12:
+		case 7:
+			n = int(r.read(16)) + 1
+		default:
+			t.Fatalf("frame %d: block size code %d", frame, blockCode)
+		}
+		if crc := uint8(r.read(8)); crc != crc8(b[start:r.pos/8-1]) {
+			t.Fatalf("frame %d: header CRC-8 %#x, want %#x", frame, crc, crc8(b[start:r.pos/8-1]))
+		}
+
+		channels := s.channels
+		if assignment < 8 && assignment+1 != channels {
+			t.Fatalf("frame %d: %d channels in a %d channel stream", frame, assignment+1, channels)
+		}
+		decoded := make([][]int64, channels)
+		for c := range decoded {
+			bps := uint(16)
+			if (assignment == channelsLeftSide && c == 1) || (assignment == channelsRightSide && c == 0) || (assignment == channelsMidSide && c == 1) {
+				bps++
+			}
+			decoded[c] = decodeFLACTestSubframe(t, r, n, bps)
+		}
+		for i := 0; i < n; i++ {
+			switch assignment {
+			case channelsLeftSide:
+				decoded[1][i] = decoded[0][i] - decoded[1][i]
+			case channelsRightSide:
+				decoded[0][i] += decoded[1][i]
+			case channelsMidSide:
+				side := decoded[1][i]
+				mid := decoded[0][i]<<1 | side&1
+				decoded[0][i], decoded[1][i] = (mid+side)>>1, (mid-side)>>1
+			}
+		}
+
+		r.align()
+		end := r.pos / 8
+		if crc := uint16(r.read(16)); crc != crc16(b[start:end]) {
+			t.Fatalf("frame %d: CRC-16 %#x, want %#x", frame, crc, crc16(b[start:end]))
+		}
+		for i := 0; i < n; i++ {
+			for c := range decoded {
+				s.pcm = binary.LittleEndian.AppendUint16(s.pcm, uint16(int16(decoded[c][i])))
+			}
+		}
+	}
+	return s
+}
+
+func decodeFLACTestSubframe(t *testing.T, r *flacTestReader, n int, bps uint) []int64 {
+	t.Helper()
+	header := r.read(8)
+	if header&0x81 != 0 {
+		t.Fatalf("subframe header %#x has padding or wasted bits set", header)
+	}
+	kind := header >> 1
+	x := make([]int64, n)
+	switch {
+	case kind == 0:
+		v := r.readSigned(bps)
+		for i := range x {
+			x[i] = v
+		}
+	case kind == 1:
+		for i := range x {
+			x[i] = r.readSigned(bps)
+		}
+	case kind&0x38 == 0x08 && kind&7 <= 4:
+		order := int(kind & 7)
+		for i := 0; i < order; i++ {
+			x[i] = r.readSigned(bps)
+		}
+		if method := r.read(2); method != 0 {
+			t.Fatalf("residual coding method %d", method)
+		}
+		partOrder := r.read(4)
+		i := order
+		for p := 0; p < 1<<partOrder; p++ {
+			k := uint(r.read(4))
+			count := n >> partOrder
+			if p == 0 {
+				count -= order
+			}
+			for j := 0; j < count; j++ {
+				u := r.readUnary()<<k | r.read(k)
+				x[i] = int64(u>>1) ^ -int64(u&1)
+				i++
+			}
+		}
+		coefs := [][]int64{{}, {1}, {2, -1}, {3, -3, 1}, {4, -6, 4, -1}}[order]
+		for i := order; i < n; i++ {
+			for j, c := range coefs {
+				x[i] += c * x[i-1-j]
+			}
+		}
+	default:
+		t.Fatalf("unexpected subframe type %#x", kind)
+	}
+	return x
+}
+
+// flacTestPCM makes frames of interleaved PCM that mix a tone, noise and
+// silence, so that every kind of subframe gets used.
+func flacTestPCM(frames, channels int) []byte {
+	var pcm []byte
+	seed := uint32(1)
+	for i := 0; i < frames; i++ {
+		for c := 0; c < channels; c++ {
+			seed = seed*1664525 + 1013904223
+			var v float64
+			switch {
+			case i/flacBlockSize == 1:
+				// A silent block gives constant subframes.
+			case c == 2:
+				v = float64(int16(seed >> 16))
+			default:
+				v = 12000*math.Sin(float64(i)*0.01*float64(c+1)) + float64(int8(seed>>24))
+			}
+			pcm = binary.LittleEndian.AppendUint16(pcm, uint16(int16(v)))
+		}
+	}
+	return pcm
+}
+
+func TestWriteFLACRoundTrip(t *testing.T) {
+	for _, channels := range []int{1, 2, 3} {
+		t.Run(fmt.Sprintf("%d channels", channels), func(t *testing.T) {
+			// Three full blocks and a short one.
+			frames := 3*flacBlockSize + 1000
+			pcm := flacTestPCM(frames, channels)
+			format := pcmFormat{sampleRate: 48000, channels: channels}
+
+			tags := []tag{{"TITLE", fmt.Sprint(channels)}}
+
+			dst := filepath.Join(t.TempDir(), "out.flac")
+			if err := writeFLAC(dst, format, tags, bytes.NewReader(pcm)); err != nil {
+				t.Fatal(err)
+			}
+			b, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := decodeFLACTest(t, b)
+			if s.sampleRate != 48000 || s.channels != channels || s.samples != uint64(frames) {
+				t.Errorf("STREAMINFO says %d Hz, %d channels, %d samples", s.sampleRate, s.channels, s.samples)
+			}
+			if !bytes.Equal(s.comments, vorbisComments(tags)) {
+				t.Errorf("VORBIS_COMMENT block is % x", s.comments)
+			}
+			if s.md5 != md5.Sum(pcm) {
+				t.Errorf("STREAMINFO MD5 does not match the PCM")
+			}
+			if !bytes.Equal(s.pcm, pcm) {
+				t.Errorf("decoded audio differs from the input")
+			}
+		})
+	}
+}
+
+func TestFLACUTF8FrameNumbers(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want []byte
+	}{
+		{0x00, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0xc2, 0x80}},
+		{0x7ff, []byte{0xdf, 0xbf}},
+		{0x800, []byte{0xe0, 0xa0, 0x80}},
+		{0x10000, []byte{0xf0, 0x90, 0x80, 0x80}},
+		{1<<31 - 1, []byte{0xfd, 0xbf, 0xbf, 0xbf, 0xbf, 0xbf}},
+		{1 << 35, []byte{0xfe, 0xa0, 0x80, 0x80, 0x80, 0x80, 0x80}},
+	}
+	for _, tt := range tests {
+		var w bitWriter
+		w.writeUTF8(tt.v)
+		if !bytes.Equal(w.bytes(), tt.want) {
+			t.Errorf("%#x: got % x, want % x", tt.v, w.bytes(), tt.want)
+		}
+		r := &flacTestReader{buf: w.bytes()}
+		if got := r.readUTF8(); got != tt.v {
+			t.Errorf("% x: read back %#x", tt.want, got)
+		}
+	}
+}
+
+func TestFLACCRCs(t *testing.T) {
+	// The check values of CRC-8/SMBUS and CRC-16/UMTS, the CRCs FLAC uses.
+	if got := crc8([]byte("123456789")); got != 0xf4 {
+		t.Errorf("crc8 = %#x, want 0xf4", got)
+	}
+	if got := crc16([]byte("123456789")); got != 0xfee8 {
+		t.Errorf("crc16 = %#x, want 0xfee8", got)
+	}
+}
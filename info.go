@@ -0,0 +1,315 @@
+package main
+
+import (
+	"blurlconvert/blurldecrypt"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type blurlInfo struct {
+	Input     string         `json:"input"`
+	Type      string         `json:"type"`
+	AudioOnly bool           `json:"audioonly"`
+	PartySync bool           `json:"partysync"`
+	Encrypted bool           `json:"encrypted"`
+	Envelope  *envelopeInfo  `json:"envelope,omitempty"`
+	Playlists []playlistInfo `json:"playlists"`
+}
+
+type envelopeInfo struct {
+	FirstByte      int    `json:"firstByte"`
+	Nonce          string `json:"nonce"`
+	Keystore       string `json:"keystore,omitempty"`
+	KeystoreRecord int64  `json:"keystoreRecord"`
+	KeystoreError  string `json:"keystoreError,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+type playlistInfo struct {
+	Index         int           `json:"index"`
+	Language      string        `json:"language"`
+	Type          string        `json:"type"`
+	Duration      float64       `json:"duration"`
+	URL           string        `json:"url"`
+	Manifest      *manifestInfo `json:"manifest,omitempty"`
+	ManifestError string        `json:"manifestError,omitempty"`
+}
+
+type manifestInfo struct {
+	Type           string           `json:"type"`
+	Profiles       string           `json:"profiles,omitempty"`
+	Duration       float64          `json:"duration"`
+	AdaptationSets []adaptationInfo `json:"adaptationSets"`
+}
+
+type adaptationInfo struct {
+	ID              string               `json:"id"`
+	ContentType     string               `json:"contentType"`
+	Addressing      string               `json:"addressing"`
+	Segments        int                  `json:"segments,omitempty"`
+	SegmentsError   string               `json:"segmentsError,omitempty"`
+	KIDs            []KID                `json:"kids,omitempty"`
+	PSSH            []PSSH               `json:"pssh,omitempty"`
+	Representations []representationInfo `json:"representations"`
+}
+
+type representationInfo struct {
+	ID           string `json:"id"`
+	MimeType     string `json:"mimeType,omitempty"`
+	Codecs       string `json:"codecs,omitempty"`
+	SamplingRate int    `json:"samplingRate,omitempty"`
+	Bandwidth    int64  `json:"bandwidth,omitempty"`
+	Channels     string `json:"channels,omitempty"`
+}
+
+// describeBLURL collects what is known about a blurl. The manifests are only
+// fetched when online is set; media segments are never downloaded.
+func describeBLURL(input string, blurl *BLURL, keystore string, online bool) blurlInfo {
+	info := blurlInfo{
+		Input:     input,
+		Type:      blurl.Type,
+		AudioOnly: blurl.AudioOnly,
+		PartySync: blurl.PartySync,
+		Encrypted: blurl.Ev != "",
+	}
+
+	if blurl.Ev != "" {
+		info.Envelope = describeEnvelope(blurl.Ev, keystore)
+	}
+
+	for i, p := range blurl.Playlists {
+		pi := playlistInfo{
+			Index:    i + 1,
+			Language: p.Language,
+			Type:     p.Type,
+			Duration: p.Duration,
+			URL:      p.URL,
+		}
+		if online && p.URL != "" {
+			m, err := describeManifest(p.URL)
+			if err != nil {
+				pi.ManifestError = err.Error()
+			} else {
+				pi.Manifest = m
+			}
+		}
+		info.Playlists = append(info.Playlists, pi)
+	}
+
+	return info
+}
+
+func describeEnvelope(ev, keystore string) *envelopeInfo {
+	e := &envelopeInfo{KeystoreRecord: -1}
+
+	decoded, err := base64.StdEncoding.DecodeString(ev)
+	if err != nil {
+		e.Error = fmt.Sprintf("error decoding base64 envelope: %v", err)
+		return e
+	}
+
+	parsed, err := blurldecrypt.ParseEV(decoded)
+	e.FirstByte = int(parsed.FirstByte)
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+	e.Nonce = parsed.Nonce
+
+	if keystore == "" {
+		return e
+	}
+	e.Keystore = findKeystore(keystore)
+	e.KeystoreRecord, err = blurldecrypt.FindRecord(e.Keystore, parsed.Nonce)
+	if err != nil {
+		e.KeystoreError = err.Error()
+	}
+	return e
+}
+
+func describeManifest(playlistURL string) (*manifestInfo, error) {
+	mediaurl, err := RemoveDuplicateUUIDPath(playlistURL)
+	if err != nil {
+		return nil, err
+	}
+
+	mpd, err := GetPlaylistMetadataByID(mediaurl)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := GetPlaylistDuration(mpd)
+	m := &manifestInfo{
+		Type:     "static",
+		Profiles: mpd.Profiles,
+		Duration: duration,
+	}
+	if mpd.Type != "" {
+		m.Type = mpd.Type
+	}
+
+	for _, set := range mpd.Period.AdaptationSet {
+		a := adaptationInfo{
+			ID:          set.ID,
+			ContentType: set.ContentType,
+		}
+
+		for _, cp := range set.ContentProtection {
+			if kid, ok := cp.kid(); ok {
+				a.KIDs = appendKID(a.KIDs, kid)
+			}
+		}
+		a.PSSH = manifestPSSH(set.ContentProtection)
+
+		best, bestBw := -1, int64(-1)
+		for i, r := range set.Representation {
+			bw, _ := strconv.ParseInt(r.Bandwidth, 10, 64)
+			rate, _ := strconv.Atoi(r.AudioSamplingRate)
+			a.Representations = append(a.Representations, representationInfo{
+				ID:           r.ID,
+				MimeType:     r.MimeType,
+				Codecs:       r.Codecs,
+				SamplingRate: rate,
+				Bandwidth:    bw,
+				Channels:     r.AudioChannelConfiguration.Value,
+			})
+			if bw > bestBw {
+				best, bestBw = i, bw
+			}
+		}
+
+		if best >= 0 {
+			r := set.Representation[best]
+
+			tpl := r.SegmentTemplate
+			if tpl.Media == "" {
+				tpl = set.SegmentTemplate
+			}
+
+			// Only the init segment is read, for the pssh boxes in its moov.
+			init := TrackDownload{BaseURL: getBaseURL(mediaurl)}
+
+			switch {
+			case tpl.Media != "":
+				init.MediaTemplate = tpl.Media
+				init.InitFile = strings.ReplaceAll(tpl.Initialization, "$RepresentationID$", r.ID)
+				a.Addressing = "template"
+				n, err := templateSegments(duration, tpl.Duration, tpl.Timescale)
+				if err != nil {
+					a.SegmentsError = err.Error()
+				}
+				a.Segments = int(n)
+			case r.SegmentBase.IndexRange != "":
+				a.Addressing = "segment-base"
+				init.FullFileURL = getBaseURL(mediaurl) + strings.TrimSpace(r.BaseURL)
+				init.InitRange = r.SegmentBase.Initialization.Range
+				segments, err := segmentsFromSegmentBase(trackRef{}, init.FullFileURL, r.SegmentBase.IndexRange)
+				if err != nil {
+					a.SegmentsError = err.Error()
+				}
+				a.Segments = len(segments)
+			case strings.TrimSpace(r.BaseURL) != "":
+				a.Addressing = "single-file"
+				a.Segments = 1
+			default:
+				a.Addressing = "unknown"
+			}
+
+			if buf, err := init.fetchInit(trackRef{}); err == nil && buf != nil {
+				found, _ := initPSSH(buf)
+				a.PSSH = uniquePSSH(append(a.PSSH, found...))
+			}
+		}
+
+		m.AdaptationSets = append(m.AdaptationSets, a)
+	}
+
+	return m, nil
+}
+
+func writeInfoJSON(w io.Writer, info blurlInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+func writeInfoText(w io.Writer, info blurlInfo) {
+	fmt.Fprintf(w, "Input:      %s\n", info.Input)
+	fmt.Fprintf(w, "Type:       %s\n", info.Type)
+	fmt.Fprintf(w, "Audio only: %v\n", info.AudioOnly)
+	fmt.Fprintf(w, "Party sync: %v\n", info.PartySync)
+	fmt.Fprintf(w, "Encrypted:  %v\n", info.Encrypted)
+
+	if e := info.Envelope; e != nil {
+		fmt.Fprintf(w, "Envelope:\n")
+		fmt.Fprintf(w, "  First byte: %d\n", e.FirstByte)
+		if e.Error != "" {
+			fmt.Fprintf(w, "  Error:      %s\n", e.Error)
+		} else {
+			fmt.Fprintf(w, "  Nonce:      %s\n", e.Nonce)
+		}
+		switch {
+		case e.Keystore == "":
+		case e.KeystoreError != "":
+			fmt.Fprintf(w, "  Keystore:   %s (%s)\n", e.Keystore, e.KeystoreError)
+		case e.KeystoreRecord < 0:
+			fmt.Fprintf(w, "  Keystore:   %s (no matching record)\n", e.Keystore)
+		default:
+			fmt.Fprintf(w, "  Keystore:   %s (record at 0x%x)\n", e.Keystore, e.KeystoreRecord)
+		}
+	}
+
+	fmt.Fprintf(w, "Playlists:\n")
+	for _, p := range info.Playlists {
+		fmt.Fprintf(w, "  %d: %s %s %.2fs\n", p.Index, p.Language, p.Type, p.Duration)
+		fmt.Fprintf(w, "     URL:      %s\n", p.URL)
+		if p.ManifestError != "" {
+			fmt.Fprintf(w, "     Manifest: %s\n", p.ManifestError)
+		}
+		if m := p.Manifest; m != nil {
+			fmt.Fprintf(w, "     Manifest: %s, %s, %d adaptation sets\n", m.Type, formatClock(time.Duration(m.Duration*float64(time.Second))), len(m.AdaptationSets))
+			for _, a := range m.AdaptationSets {
+				segments := strconv.Itoa(a.Segments)
+				if a.SegmentsError != "" {
+					segments = "? (" + a.SegmentsError + ")"
+				}
+				fmt.Fprintf(w, "     %s (id %s): %s addressing, %s segments\n", a.ContentType, a.ID, a.Addressing, segments)
+				for _, kid := range a.KIDs {
+					fmt.Fprintf(w, "       KID %s\n", kid)
+				}
+				for _, p := range a.PSSH {
+					kids := "no KIDs"
+					if len(p.KIDs) > 0 {
+						kids = "KIDs " + joinKIDs(p.KIDs, ", ")
+					}
+					fmt.Fprintf(w, "       PSSH %s from %s: %s\n", p.describe(), p.Source, kids)
+				}
+				for _, r := range a.Representations {
+					fmt.Fprintf(w, "       %s: %s\n", r.ID, describeRepresentation(r))
+				}
+			}
+		}
+	}
+}
+
+func describeRepresentation(r representationInfo) string {
+	var parts []string
+	if r.Codecs != "" {
+		parts = append(parts, r.Codecs)
+	}
+	if r.SamplingRate > 0 {
+		parts = append(parts, fmt.Sprintf("%d Hz", r.SamplingRate))
+	}
+	if r.Channels != "" {
+		parts = append(parts, r.Channels+" ch")
+	}
+	if r.Bandwidth > 0 {
+		parts = append(parts, fmt.Sprintf("%d kbit/s", r.Bandwidth/1000))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"blurlconvert/blurldecrypt"
+	"blurlconvert/festdecrypt"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var errKeyNotFound = errors.New("decryption key not found")
+
+// KeyRequest carries what a KeyProvider may need to resolve the content key.
+type KeyRequest struct {
+	EV string
+	// PSSH lists the protection headers of the manifest and init segments, so
+	// a provider can see which DRM systems the tracks claim and which KIDs
+	// they need. It is empty when no manifest was fetched.
+	PSSH []PSSH
+	// KIDs are the default KIDs of the tracks, from the tenc boxes of their
+	// init segments and the default_KID of the manifest.
+	KIDs []KID
+}
+
+// KeyProvider resolves the content key for an encrypted blurl.
+type KeyProvider interface {
+	Name() string
+	Key(req KeyRequest) ([]byte, error)
+}
+
+type keystoreProvider struct {
+	path string
+}
+
+func (p keystoreProvider) Name() string {
+	return "keystore"
+}
+
+func (p keystoreProvider) Key(req KeyRequest) ([]byte, error) {
+	decodedEV, err := base64.StdEncoding.DecodeString(req.EV)
+	if err != nil {
+		return nil, withExit(exitInput, fmt.Errorf("error decoding base64 envelope: %v", err))
+	}
+
+	parsedev, err := blurldecrypt.ParseEV(decodedEV)
+	if err != nil {
+		return nil, withExit(exitInput, fmt.Errorf("error parsing EV: %v", err))
+	}
+
+	if _, err := os.Stat(p.path); err != nil {
+		return nil, withExit(exitKeyNotFound, fmt.Errorf("keystore %s: %v", p.path, err))
+	}
+
+	key := blurldecrypt.GetEncryptionKey(p.path, parsedev.Nonce, parsedev.Key[:])
+	if key == nil {
+		return nil, withExit(exitKeyNotFound, fmt.Errorf("%w for nonce %s in %s", errKeyNotFound, parsedev.Nonce, p.path))
+	}
+
+	return key, nil
+}
+
+type staticKeyProvider struct {
+	key []byte
+}
+
+func (p staticKeyProvider) Name() string {
+	return "static"
+}
+
+func (p staticKeyProvider) Key(req KeyRequest) ([]byte, error) {
+	return p.key, nil
+}
+
+type bearerKeyProvider struct {
+	bearer string
+}
+
+func (p bearerKeyProvider) Name() string {
+	return "bearer"
+}
+
+func (p bearerKeyProvider) Key(req KeyRequest) ([]byte, error) {
+	keys, err := festdecrypt.GetFestEncryptionKeys(req.EV, p.bearer)
+	if err != nil {
+		return nil, withExit(exitKeyNotFound, fmt.Errorf("%w: %v", errKeyNotFound, err))
+	}
+
+	// Envelopes usually hold one key. When one of several has the kid of a
+	// track, that is the key; otherwise the first is used.
+	hexKey := keys[0].Key
+	for _, k := range keys {
+		if kid, err := ParseJWKKID(k.KID); err == nil && slices.Contains(req.KIDs, kid) {
+			hexKey = k.Key
+			break
+		}
+	}
+	if hexKey == "" {
+		return nil, withExit(exitKeyNotFound, errKeyNotFound)
+	}
+
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, withExit(exitKeyNotFound, fmt.Errorf("%w: %v", errKeyNotFound, err))
+	}
+	return key, nil
+}
+
+func newKeyProvider(keystore, hexKey, bearer string) (KeyProvider, error) {
+	switch {
+	case hexKey != "":
+		key, err := hex.DecodeString(strings.TrimSpace(hexKey))
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("--key must be 32 hex characters")
+		}
+		return staticKeyProvider{key: key}, nil
+	case bearer != "":
+		return bearerKeyProvider{bearer: bearer}, nil
+	}
+
+	return keystoreProvider{path: findKeystore(keystore)}, nil
+}
+
+// findKeystore falls back to the executable's directory for a relative keystore path.
+func findKeystore(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if _, err := os.Stat(path); err == nil {
+		abs, err := filepath.Abs(path)
+		if err == nil {
+			return abs
+		}
+		return path
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return path
+	}
+	candidate := filepath.Join(filepath.Dir(exe), path)
+	if _, err := os.Stat(candidate); err == nil {
+		return candidate
+	}
+	return path
+}
+
+// contentKey is the key of a blurl's envelope. It is resolved when the first
+// playlist that needs it has been planned, and shared by the others.
+type contentKey struct {
+	ev       string
+	provider KeyProvider
+
+	resolved bool
+	key      []byte
+	kids     []KID
+	err      error
+}
+
+func (c *contentKey) resolve(ref trackRef, mpd *MPD, tracks []TrackDownload) ([]byte, error) {
+	if c.resolved {
+		return c.key, c.err
+	}
+	c.resolved = true
+
+	req := newKeyRequest(ref, c.ev, mpd, tracks)
+	c.kids = req.KIDs
+	c.key, c.err = c.provider.Key(req)
+	if c.err == nil {
+		ref.logger().Debug("decryption key resolved", "provider", c.provider.Name(), "kids", joinKIDs(c.kids, ","))
+	}
+	return c.key, c.err
+}
+
+// newKeyRequest gathers what protects a playlist from its manifest and from
+// the init segments of the planned tracks. An init segment that cannot be
+// fetched is skipped; downloading the track reports the error.
+func newKeyRequest(ref trackRef, ev string, mpd *MPD, tracks []TrackDownload) KeyRequest {
+	log := ref.logger()
+	req := KeyRequest{EV: ev}
+
+	manifestKIDs := defaultKIDs(mpd)
+	for _, set := range mpd.Period.AdaptationSet {
+		req.PSSH = append(req.PSSH, manifestPSSH(set.ContentProtection)...)
+	}
+
+	for _, t := range tracks {
+		buf, err := t.fetchInit(ref)
+		if err != nil {
+			log.Debug("error fetching init segment", "track", t.MediaType, "error", err)
+			continue
+		}
+		if buf == nil {
+			continue
+		}
+		found, err := initPSSH(buf)
+		if err != nil {
+			log.Debug("error reading pssh from init segment", "track", t.MediaType, "error", err)
+		}
+		req.PSSH = append(req.PSSH, found...)
+
+		kids, err := initKIDs(buf)
+		if err != nil {
+			log.Debug("error reading tenc from init segment", "track", t.MediaType, "error", err)
+		}
+		for _, kid := range kids {
+			if len(manifestKIDs) > 0 && !slices.Contains(manifestKIDs, kid) {
+				log.Warn("the init segment's KID is not a default_KID of the manifest", "track", t.MediaType, "kid", kid.String(), "manifest", joinKIDs(manifestKIDs, ","))
+			}
+			req.KIDs = appendKID(req.KIDs, kid)
+		}
+	}
+	for _, kid := range manifestKIDs {
+		req.KIDs = appendKID(req.KIDs, kid)
+	}
+
+	req.PSSH = uniquePSSH(req.PSSH)
+	for _, p := range req.PSSH {
+		log.Debug("protection system", "system", p.describe(), "source", p.Source, "kids", joinKIDs(p.KIDs, ","))
+	}
+	if len(req.KIDs) > 0 {
+		log.Debug("content KIDs", "kids", joinKIDs(req.KIDs, ","))
+	}
+	return req
+}
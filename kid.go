@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"blurlconvert/bmff"
+)
+
+// KID is the ID of a content key. Manifests write it as a dashed hex UUID
+// (default_KID), tenc and pssh boxes as 16 raw bytes and JWK key sets as
+// unpadded base64url (kid).
+type KID [16]byte
+
+// ParseKID reads a KID written as hex, with or without the dashes of a UUID.
+func ParseKID(s string) (KID, error) {
+	var k KID
+	h := strings.ReplaceAll(strings.TrimSpace(s), "-", "")
+	if len(h) != 32 {
+		return k, fmt.Errorf("invalid KID %q, expected 32 hex characters", s)
+	}
+	if _, err := hex.Decode(k[:], []byte(h)); err != nil {
+		return k, fmt.Errorf("invalid KID %q: %v", s, err)
+	}
+	return k, nil
+}
+
+// ParseJWKKID reads the kid of a JSON web key, which is base64url with or
+// without padding.
+func ParseJWKKID(s string) (KID, error) {
+	var k KID
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+	if err != nil {
+		return k, fmt.Errorf("invalid JWK kid %q: %v", s, err)
+	}
+	if len(b) != len(k) {
+		return k, fmt.Errorf("invalid JWK kid %q: %d bytes, expected 16", s, len(b))
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+func (k KID) String() string {
+	return formatUUID(k)
+}
+
+// JWK writes the KID the way JSON web keys do.
+func (k KID) JWK() string {
+	return base64.RawURLEncoding.EncodeToString(k[:])
+}
+
+func (k KID) IsZero() bool {
+	return k == KID{}
+}
+
+func (k KID) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// kid parses the default_KID of a ContentProtection element. ok is false
+// when it has none or it is not a UUID.
+func (cp contentProtection) kid() (KID, bool) {
+	k, err := ParseKID(cp.DefaultKID)
+	return k, err == nil
+}
+
+// defaultKIDs lists the distinct default_KIDs of a manifest's adaptation
+// sets. Values that are not UUIDs are skipped.
+func defaultKIDs(mpd *MPD) []KID {
+	var kids []KID
+	for _, set := range mpd.Period.AdaptationSet {
+		for _, cp := range set.ContentProtection {
+			if k, ok := cp.kid(); ok {
+				kids = appendKID(kids, k)
+			}
+		}
+	}
+	return kids
+}
+
+// initKIDs reads the default KIDs from the tenc boxes of the encrypted sample
+// entries in an init segment.
+func initKIDs(buf []byte) ([]KID, error) {
+	boxes, err := bmff.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	var kids []KID
+	for _, trak := range bmff.FindAll(boxes, "moov", "trak") {
+		b, ok := trak.Find("mdia", "minf", "stbl", "stsd")
+		if !ok {
+			continue
+		}
+		stsd, err := bmff.ParseStsd(b)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range stsd.Entries {
+			if entry.Type != "encv" && entry.Type != "enca" {
+				continue
+			}
+			e, err := bmff.ParseSampleEntry(entry)
+			if err != nil {
+				return nil, err
+			}
+			tenc, err := e.Tenc()
+			if err != nil {
+				return nil, err
+			}
+			kids = appendKID(kids, KID(tenc.DefaultKID))
+		}
+	}
+	return kids, nil
+}
+
+func appendKID(kids []KID, k KID) []KID {
+	for _, v := range kids {
+		if v == k {
+			return kids
+		}
+	}
+	return append(kids, k)
+}
+
+func joinKIDs(kids []KID, sep string) string {
+	s := make([]string, len(kids))
+	for i, k := range kids {
+		s[i] = k.String()
+	}
+	return strings.Join(s, sep)
+}
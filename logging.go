@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+func setupLogger(w io.Writer, verbose, quiet bool, format string) error {
+	level := slog.LevelInfo
+	switch {
+	case verbose && quiet:
+		return fmt.Errorf("-v and -q cannot be used together")
+	case verbose:
+		level = slog.LevelDebug
+	case quiet:
+		level = slog.LevelWarn
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch format {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("unknown log format %q (want text or json)", format)
+	}
+
+	slog.SetDefault(slog.New(reportHandler{Handler: handler}))
+	return nil
+}
@@ -1,276 +1,181 @@
 package main
 
 import (
-	"blurlconvert/blurldecrypt"
-	"encoding/base64"
-	"encoding/hex"
+	"errors"
+	"flag"
 	"fmt"
-	"math"
+	"io"
+	"log/slog"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
-	"time"
 )
 
-func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: program <input.blurl|input.json> <output>")
-		return
-	}
+const usage = `Usage: blurlconvert <command> [flags] <input>... [output]
 
-	if !strings.HasSuffix(os.Args[1], ".blurl") && !strings.HasSuffix(os.Args[1], ".json") {
-		fmt.Println("The Input File must be a .blurl or .json file")
-		return
-	}
+Commands:
+  convert   download, decrypt and mux a blurl into media files (default)
+  info      show what a blurl contains
+  fetch     download the selected playlist without decrypting it
+  keys      resolve and print the decryption key of a blurl
+  pack      pack a blurl JSON file into a .blurl file
 
-	var blurl BLURL
+Run 'blurlconvert <command> -h' to see the flags of a command.
+`
 
-	if strings.HasSuffix(os.Args[1], ".blurl") {
-		err := parseBLURL(&blurl, os.Args[1])
-		if err != nil {
-			fmt.Printf("Error parsing BLURL file: %v\n", err)
-			return
-		}
-	} else {
-		err := parseBLURLFromJSON(&blurl, os.Args[1])
-		if err != nil {
-			fmt.Printf("Error parsing JSON file: %v\n", err)
-			return
-		}
-	}
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
 
-	var mediaurl string
-	if len(blurl.Playlists) == 1 {
-		mediaurl = blurl.Playlists[0].URL
-	} else {
-		mediaurl = GetMediaURL(&blurl)
-	}
+var commands []command
 
-	if mediaurl == "" {
-		fmt.Println("No valid media URL selected")
-		return
+func init() {
+	commands = []command{
+		{"convert", "<input|dir|glob>... [output]", cmdConvert},
+		{"info", "<input.blurl|input.json>", cmdInfo},
+		{"fetch", "<input|dir|glob>... [output]", cmdFetch},
+		{"keys", "<input.blurl|input.json>", cmdKeys},
+		{"pack", "<input.json> [output.blurl]", cmdPack},
 	}
+}
 
-	var key []byte
-
-	if len(blurl.Ev) > 0 {
-		decodedEV, err := base64.StdEncoding.DecodeString(blurl.Ev)
-		if err != nil {
-			fmt.Println("Error decoding base64:", err)
-			return
-		}
-
-		parsedev, err := blurldecrypt.ParseEV(decodedEV)
-		if err != nil {
-			fmt.Println("Error parsing EV:", err)
-			return
-		}
-
-		key = blurldecrypt.GetEncryptionKey("keys.bin", parsedev.Nonce, parsedev.Key[:])
-		if key == nil {
-			fmt.Println("Failed to get encryption key")
-			return
-		}
-
-		fmt.Printf("Decryption Key: %02x\n", key)
+func main() {
+	err := run(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		err = nil
 	}
-
-	mediaurl, err := RemoveDuplicateUUIDPath(mediaurl)
-	if err != nil {
-		fmt.Printf("Error processing URL: %v\n", err)
-		return
+	if err != nil && !errors.Is(err, errUsage) {
+		slog.Error(err.Error())
 	}
+	os.Exit(exitCode(err))
+}
 
-	mpddata, err := GetPlaylistMetadataByID(mediaurl)
-	if err != nil {
-		fmt.Println("Error getting playlist metadata:", err)
-		return
+func run(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return withExit(exitUsage, errUsage)
 	}
 
-	trackduration := GetPlaylistDuration(mpddata)
-	if trackduration <= 0 {
-		fmt.Println("Track Duration is 0 or invalid, exiting!")
-		return
+	switch args[0] {
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+		return nil
 	}
 
-	if len(mpddata.Period.AdaptationSet) == 0 {
-		fmt.Println("No AdaptationSet found in MPD, exiting!")
-		return
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
 	}
 
-	numberOfSegments := 0.0
-
-	firstSet := mpddata.Period.AdaptationSet[0]
-	if len(firstSet.Representation) == 0 {
-		fmt.Println("No Representation found in MPD, exiting!")
-		return
+	// "blurlconvert master.blurl" predates the subcommands and still converts.
+	if strings.HasPrefix(args[0], "-") || fileExists(args[0]) {
+		return cmdConvert(args)
 	}
 
-	bestRepIndex := 0
-	bestBw := int64(-1)
-	for i, r := range firstSet.Representation {
-		bw, _ := strconv.ParseInt(r.Bandwidth, 10, 64)
-		if bw > bestBw {
-			bestBw = bw
-			bestRepIndex = i
-		}
-	}
+	fmt.Fprint(os.Stderr, usage)
+	return withExit(exitUsage, fmt.Errorf("unknown command %q", args[0]))
+}
 
-	segmentDurationStr := firstSet.Representation[bestRepIndex].SegmentTemplate.Duration
-	segmentTimescaleStr := firstSet.Representation[bestRepIndex].SegmentTemplate.Timescale
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
 
-	if segmentDurationStr == "" {
-		segmentDurationStr = firstSet.SegmentTemplate.Duration
-	}
-	if segmentTimescaleStr == "" {
-		segmentTimescaleStr = firstSet.SegmentTemplate.Timescale
-	}
+type commonFlags struct {
+	verbose   bool
+	quiet     bool
+	logFormat string
+	progress  string
+	workdir   string
+}
 
-	if segmentDurationStr != "" && segmentTimescaleStr != "" {
-		segmentDuration, err := strconv.ParseInt(segmentDurationStr, 10, 64)
-		if err != nil {
-			fmt.Println("Error parsing segment duration:", err)
-			return
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		for _, c := range commands {
+			if c.name == name {
+				fmt.Fprintf(fs.Output(), "Usage: blurlconvert %s [flags] %s\n\nFlags:\n", c.name, c.summary)
+			}
 		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
 
-		timescale, err := strconv.ParseInt(segmentTimescaleStr, 10, 64)
-		if err != nil {
-			fmt.Println("Error parsing timescale:", err)
-			return
-		}
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	c := &commonFlags{}
+	fs.BoolVar(&c.verbose, "v", false, "verbose logging")
+	fs.BoolVar(&c.quiet, "q", false, "only log warnings and errors")
+	fs.StringVar(&c.logFormat, "log-format", "text", "log format: text or json")
+	fs.StringVar(&c.progress, "progress", "auto", "progress output: auto, bar, json or none")
+	fs.StringVar(&c.workdir, "C", "", "directory for temporary workspaces instead of the system temp directory")
+	fs.StringVar(&c.workdir, "workdir", "", "directory for temporary workspaces instead of the system temp directory")
+	return c
+}
 
-		numberOfSegments = math.Ceil(trackduration / (float64(segmentDuration) / float64(timescale)))
-	} else {
-		numberOfSegments = 1
+// apply sets up logging and progress, then switches to the working directory.
+// Paths given on the command line are made absolute first so they keep pointing
+// at what the user meant.
+func (c *commonFlags) apply(paths ...*string) error {
+	reporter, err := newProgressReporter(c.progress, os.Stderr)
+	if err != nil {
+		return withExit(exitUsage, err)
 	}
+	progress = reporter
 
-	if numberOfSegments <= 0 {
-		fmt.Println("Invalid number of track segments! exiting.")
-		return
+	// The progress bar is redrawn over itself, so log lines go through it to
+	// be printed above the bar rather than into it.
+	var logw io.Writer = os.Stderr
+	if w, ok := reporter.(io.Writer); ok {
+		logw = w
+	}
+	if err := setupLogger(logw, c.verbose, c.quiet, c.logFormat); err != nil {
+		return withExit(exitUsage, err)
 	}
 
-	fmt.Printf("===================================================================================\n")
-	fmt.Printf("Media Codec: %s\n", mpddata.Period.AdaptationSet[0].Representation[bestRepIndex].Codecs)
-	fmt.Printf("Sample Rate: %skHz\n", mpddata.Period.AdaptationSet[0].Representation[bestRepIndex].AudioSamplingRate)
-	fmt.Printf("===================================================================================\n")
-
-	if !isDirExists("downloads") {
-		err := os.Mkdir("downloads", 0755)
-		if err != nil {
-			fmt.Printf("Error creating downloads directory: %v\n", err)
-			return
-		}
+	if c.workdir == "" {
+		return nil
 	}
 
-	for _, adaptation := range mpddata.Period.AdaptationSet {
-		if len(adaptation.Representation) == 0 {
-			fmt.Printf("Error Downloading Track: no representations\n")
+	for _, p := range paths {
+		if *p == "" {
 			continue
 		}
-
-		repIndex := 0
-		repBw := int64(-1)
-		for i, r := range adaptation.Representation {
-			bw, _ := strconv.ParseInt(r.Bandwidth, 10, 64)
-			if bw > repBw {
-				repBw = bw
-				repIndex = i
-			}
-		}
-
-		contentType := strings.TrimSpace(adaptation.ContentType)
-		if contentType == "" {
-			m := strings.ToLower(strings.TrimSpace(adaptation.Representation[repIndex].MimeType))
-			if strings.Contains(m, "audio/") {
-				contentType = "audio"
-			} else if strings.Contains(m, "video/") {
-				contentType = "video"
-			} else {
-				contentType = "audio"
-			}
-		}
-
-		fmt.Printf("Processing %s track...\n", contentType)
-
-		initTpl := adaptation.Representation[repIndex].SegmentTemplate.Initialization
-		mediaTpl := adaptation.Representation[repIndex].SegmentTemplate.Media
-		startNumStr := adaptation.Representation[repIndex].SegmentTemplate.StartNumber
-
-		if initTpl == "" {
-			initTpl = adaptation.SegmentTemplate.Initialization
-		}
-		if mediaTpl == "" {
-			mediaTpl = adaptation.SegmentTemplate.Media
-		}
-		if startNumStr == "" {
-			startNumStr = adaptation.SegmentTemplate.StartNumber
-		}
-
-		startNumber := 1
-		if startNumStr != "" {
-			v, e := strconv.Atoi(startNumStr)
-			if e == nil && v > 0 {
-				startNumber = v
-			}
-		}
-
-		initFile := ""
-		if initTpl != "" {
-			initFile = strings.ReplaceAll(initTpl, "$RepresentationID$", adaptation.Representation[repIndex].ID)
-		} else {
-			initFile = strings.TrimSpace(adaptation.Representation[repIndex].BaseURL)
-		}
-
-		fullFileURL := ""
-		initRange := ""
-		indexRange := ""
-
-		if mediaTpl == "" {
-			baseName := strings.TrimSpace(adaptation.Representation[repIndex].BaseURL)
-			if baseName != "" {
-				fullFileURL = getBaseURL(mediaurl) + baseName
-				initRange = adaptation.Representation[repIndex].SegmentBase.Initialization.Range
-				indexRange = adaptation.Representation[repIndex].SegmentBase.IndexRange
-			}
-		}
-
-		err := HandleDownloadTrack(
-			contentType,
-			fmt.Sprintf("master_%s", contentType),
-			numberOfSegments,
-			getBaseURL(mediaurl),
-			initFile,
-			adaptation.Representation[repIndex].ID,
-			hex.EncodeToString(key),
-			mediaTpl,
-			startNumber,
-			fullFileURL,
-			initRange,
-			indexRange,
-		)
-
+		trailing := strings.HasSuffix(*p, "/") || strings.HasSuffix(*p, string(os.PathSeparator))
+		abs, err := filepath.Abs(*p)
 		if err != nil {
-			fmt.Printf("Error Downloading %s Track: %v\n", contentType, err)
-			continue
+			return err
+		}
+		if trailing {
+			abs += string(os.PathSeparator)
 		}
+		*p = abs
 	}
 
-	if len(mpddata.Period.AdaptationSet) == 2 {
-		videoFile := "master_video.mp4"
-		audioFile := "master_audio.mp4"
+	if err := os.MkdirAll(c.workdir, 0755); err != nil {
+		return err
+	}
+	return os.Chdir(c.workdir)
+}
 
-		if _, err := os.Stat(videoFile); err == nil {
-			if _, err := os.Stat(audioFile); err == nil {
-				fmt.Println("Merging audio and video tracks...")
-				Merge(videoFile, audioFile, EncodeToBase62(mpddata.Period.AdaptationSet[0].ContentProtection[0].DefaultKID)[:8])
+// parseArgs lets flags follow positional arguments, as in "convert in.blurl -o out.mp4".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return nil, err
 			}
+			return nil, withExit(exitUsage, err)
 		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
-
-	time.Sleep(1 * time.Second)
-
-	fmt.Println("Cleaning up temporary files...")
-	os.RemoveAll("./downloads")
-
-	fmt.Println("Process completed successfully!")
 }
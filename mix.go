@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// mixPresets are named mixes for --mix. A preset can be followed by more
+// entries, which override it. A stem name of * stands for every stem of the
+// stem map. Karaoke keeps the vocals as a quiet guide to sing along with.
+var mixPresets = map[string]string{
+	"karaoke":      "vocals=-18dB",
+	"instrumental": "vocals=0",
+	"acappella":    "*=0,vocals=1",
+	"no-drums":     "drums=0",
+	"no-bass":      "bass=0",
+	"no-lead":      "lead=0",
+}
+
+// mixLimit is where the limiter starts to bend peaks down, about -1 dBFS.
+const mixLimit = 0.89
+
+// parseMix reads a mix such as "karaoke,drums=-3dB" into a gain per stem.
+// Stems that the mix does not name keep a gain of 1.
+func parseMix(s string, stems []stem) (map[string]float64, error) {
+	gains := map[string]float64{}
+	for _, s := range stems {
+		gains[s.name] = 1
+	}
+
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			preset, ok := mixPresets[entry]
+			if !ok {
+				return nil, fmt.Errorf("unknown preset %q, expected one of %s", entry, strings.Join(mixPresetNames(), ", "))
+			}
+			if err := applyMix(gains, preset); err != nil {
+				return nil, fmt.Errorf("preset %s: %v", entry, err)
+			}
+			continue
+		}
+		if err := applyMix(gains, name+"="+value); err != nil {
+			return nil, err
+		}
+	}
+	return gains, nil
+}
+
+func applyMix(gains map[string]float64, s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		name, value, _ := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if _, ok := gains[name]; !ok && name != "*" {
+			return fmt.Errorf("stem %q is not in the stem map", name)
+		}
+		gain, err := parseGain(value)
+		if err != nil {
+			return fmt.Errorf("stem %s: %v", name, err)
+		}
+		if name != "*" {
+			gains[name] = gain
+			continue
+		}
+		for stem := range gains {
+			gains[stem] = gain
+		}
+	}
+	return nil
+}
+
+// parseGain reads a linear gain such as 0.5, a gain in decibels such as -3dB,
+// or mute.
+func parseGain(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+	if strings.EqualFold(s, "mute") || strings.EqualFold(s, "off") {
+		return 0, nil
+	}
+	if db, ok := strings.CutSuffix(strings.ToLower(s), "db"); ok {
+		v, err := strconv.ParseFloat(strings.TrimSpace(db), 64)
+		if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+			return 0, fmt.Errorf("invalid gain %q", s)
+		}
+		return math.Pow(10, v/20), nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 || math.IsInf(v, 0) || math.IsNaN(v) {
+		return 0, fmt.Errorf("invalid gain %q, expected a number, a value in dB or mute", s)
+	}
+	return v, nil
+}
+
+func mixPresetNames() []string {
+	var names []string
+	for name := range mixPresets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// mixStems decodes a multichannel track and writes a stereo mixdown of its
+// stems.
+func mixStems(ref trackRef, track TrackDownload, opts convertOptions, dst string) error {
+	write, err := pcmWriterFor(opts.format, track.Tags)
+	if err != nil {
+		return err
+	}
+	format, err := stemPCMFormat(ref, track, opts.stems)
+	if err != nil {
+		return err
+	}
+
+	log := ref.logger()
+	log.Debug("mixing stems", "decoder", opts.decoder.Name(), "stems", len(opts.stems), "channels", format.channels)
+
+	pcm, err := opts.decoder.Decode(track.OutputPath, format)
+	if err != nil {
+		return err
+	}
+
+	m := &stemMixer{src: trimPCM(pcm, format, track.Duration), format: format, stems: opts.stems, gains: make([]float64, len(opts.stems))}
+	for i, s := range opts.stems {
+		m.gains[i] = opts.mix[s.name]
+	}
+	err = write(dst, pcmFormat{sampleRate: format.sampleRate, channels: 2}, m)
+	if closeErr := pcm.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if m.limited > 0 {
+		log.Warn("the mix peaks above -1 dBFS, peaks were limited", "samples", m.limited)
+	}
+	return nil
+}
+
+// stemMixer reads interleaved multichannel PCM and returns it mixed down to
+// stereo. Stems with one channel go to both sides.
+type stemMixer struct {
+	src    io.Reader
+	format pcmFormat
+	stems  []stem
+	gains  []float64
+
+	in      []byte
+	out     []byte
+	limited int
+}
+
+func (m *stemMixer) Read(p []byte) (int, error) {
+	for len(m.out) == 0 {
+		if err := m.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, m.out)
+	m.out = m.out[n:]
+	return n, nil
+}
+
+func (m *stemMixer) fill() error {
+	const bytesPerSample = pcmBitsPerSample / 8
+	frameSize := m.format.frameSize()
+	if m.in == nil {
+		m.in = make([]byte, 4096*frameSize)
+	}
+
+	n, err := io.ReadFull(m.src, m.in)
+	if err == io.EOF {
+		return io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n%frameSize != 0 {
+		return fmt.Errorf("decoder returned a partial frame of %d bytes", n%frameSize)
+	}
+
+	out := m.out[:0]
+	for f := 0; f < n/frameSize; f++ {
+		frame := m.in[f*frameSize:]
+		sample := func(c int) float64 {
+			return float64(int16(uint16(frame[c*bytesPerSample])|uint16(frame[c*bytesPerSample+1])<<8)) / 32768
+		}
+
+		var left, right float64
+		for i, s := range m.stems {
+			g := m.gains[i]
+			if g == 0 {
+				continue
+			}
+			if len(s.channels) == 1 {
+				v := g * sample(s.channels[0])
+				left += v
+				right += v
+			} else {
+				left += g * sample(s.channels[0])
+				right += g * sample(s.channels[1])
+			}
+		}
+
+		for _, v := range []float64{left, right} {
+			l := limit(v)
+			if l != v {
+				m.limited++
+			}
+			s := int16(math.Round(l * 32767))
+			out = append(out, byte(s), byte(uint16(s)>>8))
+		}
+	}
+	m.out = out
+	return nil
+}
+
+// limit passes samples below mixLimit through and bends louder ones
+// smoothly towards full scale, so the mix never clips.
+func limit(v float64) float64 {
+	a := math.Abs(v)
+	if a <= mixLimit {
+		return v
+	}
+	a = mixLimit + (1-mixLimit)*math.Tanh((a-mixLimit)/(1-mixLimit))
+	return math.Copysign(a, v)
+}
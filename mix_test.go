@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+func TestMixPresets(t *testing.T) {
+	stems := []stem{{name: "vocals"}, {name: "drums"}}
+	karaoke, err := parseMix("karaoke", stems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instrumental, err := parseMix("instrumental", stems)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instrumental["vocals"] != 0 || instrumental["drums"] != 1 {
+		t.Errorf("instrumental gains %v", instrumental)
+	}
+	if v := karaoke["vocals"]; v <= 0 || v >= 0.2 || karaoke["drums"] != 1 {
+		t.Errorf("karaoke gains %v, want a quiet guide vocal", karaoke)
+	}
+}
+
+func TestStemMixerCountsLimitedSamples(t *testing.T) {
+	// Two mono stems. Each frame's sum goes to both sides: 20000/32768 is
+	// below the limiter's threshold, 30000/32768 above it but below full
+	// scale, and 2000/32768 well below it.
+	var pcm []byte
+	for _, v := range []int16{15000, 5000, 15000, 15000, 1000, 1000} {
+		pcm = binary.LittleEndian.AppendUint16(pcm, uint16(v))
+	}
+	m := &stemMixer{
+		src:    bytes.NewReader(pcm),
+		format: pcmFormat{sampleRate: 48000, channels: 2},
+		stems:  []stem{{name: "a", channels: []int{0}}, {name: "b", channels: []int{1}}},
+		gains:  []float64{1, 1},
+	}
+	if _, err := io.ReadAll(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.limited != 2 {
+		t.Errorf("%d samples limited, want the 2 of the second frame", m.limited)
+	}
+}
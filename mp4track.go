@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"blurlconvert/bmff"
+)
+
+// mp4Sample is one coded sample of a track and where its data sits in the file.
+// flags are the sample flags of a trun; cto is the composition time offset.
+type mp4Sample struct {
+	offset   int64
+	size     int
+	duration uint32
+	flags    uint32
+	cto      int32
+}
+
+// Sample flags for sync samples and samples that depend on others, as written
+// by most muxers.
+const (
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+func (s mp4Sample) sync() bool {
+	return s.flags&0x00010000 == 0
+}
+
+// mp4Track is a single track read from either a regular MP4 (sample tables in
+// moov) or a fragmented one (moof/trun).
+type mp4Track struct {
+	id             uint32
+	timescale      uint32
+	movieTimescale uint32
+	trak           bmff.Box
+	entry          bmff.Box
+	samples        []mp4Sample
+	fragmented     bool
+	// baseTime is the decode time of the first sample. It is not 0 when a
+	// file starts partway through a track, as clipped downloads do.
+	baseTime uint64
+	// gaps lists the fragments whose tfdt is not where the samples before
+	// them end.
+	gaps []mp4Gap
+	end  uint64
+
+	// The first edit, if any: where playback starts in media time and how long
+	// it lasts in movie time.
+	hasEdit      bool
+	editStart    int64
+	editDuration uint64
+}
+
+// mp4Gap is a jump in decode time between fragments, in the track's
+// timescale. length is negative where fragments overlap.
+type mp4Gap struct {
+	time   uint64
+	length int64
+}
+
+// readTrack returns the first track whose sample entry has the given type,
+// such as "Opus" or "mp4a".
+func readTrack(buf []byte, entryType string) (*mp4Track, error) {
+	tracks, err := readTracks(buf)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tracks {
+		if t.entry.Type == entryType {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s track found", entryType)
+}
+
+// readTracks returns every track of a file, in the order of its trak boxes.
+func readTracks(buf []byte) ([]*mp4Track, error) {
+	boxes, err := bmff.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	moovBox, ok := bmff.Find(boxes, "moov")
+	if !ok {
+		return nil, fmt.Errorf("no moov box")
+	}
+	moov, err := bmff.ParseMoov(moovBox)
+	if err != nil {
+		return nil, err
+	}
+	if moov.Timescale == 0 {
+		return nil, fmt.Errorf("mvhd: timescale is 0")
+	}
+
+	var tracks []*mp4Track
+	for _, trak := range moov.Traks {
+		if trak.Stsd == nil || len(trak.Stsd.Entries) == 0 {
+			continue
+		}
+		entry := trak.Stsd.Entries[0]
+		if entry.Type == "enca" || entry.Type == "encv" {
+			return nil, fmt.Errorf("track is still encrypted")
+		}
+		if trak.Mdhd == nil || trak.Mdhd.Timescale == 0 {
+			return nil, fmt.Errorf("track %d has no media timescale", trak.ID)
+		}
+
+		t := &mp4Track{
+			id:             trak.ID,
+			timescale:      trak.Mdhd.Timescale,
+			movieTimescale: moov.Timescale,
+			trak:           trak.Box,
+			entry:          entry,
+		}
+		t.readEdit()
+		if err := t.readSampleTables(); err != nil {
+			return nil, err
+		}
+		if err := t.readFragments(boxes, moovBox); err != nil {
+			return nil, err
+		}
+		if len(t.samples) == 0 {
+			return nil, fmt.Errorf("track %d has no samples", t.id)
+		}
+		tracks = append(tracks, t)
+	}
+
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no tracks found")
+	}
+	return tracks, nil
+}
+
+func (t *mp4Track) readEdit() {
+	elst, ok := t.trak.Find("edts", "elst")
+	if !ok || len(elst.Payload) < 8 {
+		return
+	}
+	p := elst.Payload
+	count := binary.BigEndian.Uint32(p[4:8])
+	switch {
+	case count == 0:
+	case p[0] == 1 && len(p) >= 8+20:
+		t.hasEdit = true
+		t.editDuration = binary.BigEndian.Uint64(p[8:16])
+		t.editStart = int64(binary.BigEndian.Uint64(p[16:24]))
+	case p[0] == 0 && len(p) >= 8+12:
+		t.hasEdit = true
+		t.editDuration = uint64(binary.BigEndian.Uint32(p[8:12]))
+		t.editStart = int64(int32(binary.BigEndian.Uint32(p[12:16])))
+	}
+}
+
+// readSampleTables reads the samples described in moov. Fragmented files have
+// empty tables here and carry their samples in moof boxes instead.
+func (t *mp4Track) readSampleTables() error {
+	stbl, ok := t.trak.Find("mdia", "minf", "stbl")
+	if !ok {
+		return fmt.Errorf("no stbl box")
+	}
+
+	var sizes []int
+	if stsz, ok := stbl.Find("stsz"); ok {
+		p := stsz.Payload
+		if len(p) < 12 {
+			return fmt.Errorf("truncated stsz")
+		}
+		fixed := binary.BigEndian.Uint32(p[4:8])
+		count := int(binary.BigEndian.Uint32(p[8:12]))
+		if fixed == 0 && len(p) < 12+4*count {
+			return fmt.Errorf("truncated stsz")
+		}
+		sizes = make([]int, count)
+		for i := range sizes {
+			if fixed != 0 {
+				sizes[i] = int(fixed)
+			} else {
+				sizes[i] = int(binary.BigEndian.Uint32(p[12+4*i:]))
+			}
+		}
+	}
+	if len(sizes) == 0 {
+		return nil
+	}
+
+	var chunks []int64
+	if stco, ok := stbl.Find("stco"); ok {
+		p := stco.Payload
+		if len(p) < 8 {
+			return fmt.Errorf("truncated stco")
+		}
+		count := int(binary.BigEndian.Uint32(p[4:8]))
+		if len(p) < 8+4*count {
+			return fmt.Errorf("truncated stco")
+		}
+		for i := 0; i < count; i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint32(p[8+4*i:])))
+		}
+	} else if co64, ok := stbl.Find("co64"); ok {
+		p := co64.Payload
+		if len(p) < 8 {
+			return fmt.Errorf("truncated co64")
+		}
+		count := int(binary.BigEndian.Uint32(p[4:8]))
+		if len(p) < 8+8*count {
+			return fmt.Errorf("truncated co64")
+		}
+		for i := 0; i < count; i++ {
+			chunks = append(chunks, int64(binary.BigEndian.Uint64(p[8+8*i:])))
+		}
+	} else {
+		return fmt.Errorf("no stco or co64 box")
+	}
+
+	stsc, ok := stbl.Find("stsc")
+	if !ok || len(stsc.Payload) < 8 {
+		return fmt.Errorf("missing or truncated stsc")
+	}
+	type stscEntry struct{ firstChunk, perChunk int }
+	var runs []stscEntry
+	count := int(binary.BigEndian.Uint32(stsc.Payload[4:8]))
+	if len(stsc.Payload) < 8+12*count {
+		return fmt.Errorf("truncated stsc")
+	}
+	for i := 0; i < count; i++ {
+		p := stsc.Payload[8+12*i:]
+		runs = append(runs, stscEntry{
+			firstChunk: int(binary.BigEndian.Uint32(p[0:4])),
+			perChunk:   int(binary.BigEndian.Uint32(p[4:8])),
+		})
+	}
+
+	var durations []uint32
+	if stts, ok := stbl.Find("stts"); ok && len(stts.Payload) >= 8 {
+		count := int(binary.BigEndian.Uint32(stts.Payload[4:8]))
+		if len(stts.Payload) < 8+8*count {
+			return fmt.Errorf("truncated stts")
+		}
+		for i := 0; i < count; i++ {
+			p := stts.Payload[8+8*i:]
+			n := binary.BigEndian.Uint32(p[0:4])
+			d := binary.BigEndian.Uint32(p[4:8])
+			for j := uint32(0); j < n && len(durations) < len(sizes); j++ {
+				durations = append(durations, d)
+			}
+		}
+	}
+
+	// Without stss every sample is a sync sample.
+	var syncSamples map[int]bool
+	if stss, ok := stbl.Find("stss"); ok && len(stss.Payload) >= 8 {
+		count := int(binary.BigEndian.Uint32(stss.Payload[4:8]))
+		if len(stss.Payload) < 8+4*count {
+			return fmt.Errorf("truncated stss")
+		}
+		syncSamples = make(map[int]bool, count)
+		for i := 0; i < count; i++ {
+			syncSamples[int(binary.BigEndian.Uint32(stss.Payload[8+4*i:]))-1] = true
+		}
+	}
+
+	var offsets []int32
+	if ctts, ok := stbl.Find("ctts"); ok && len(ctts.Payload) >= 8 {
+		count := int(binary.BigEndian.Uint32(ctts.Payload[4:8]))
+		if len(ctts.Payload) < 8+8*count {
+			return fmt.Errorf("truncated ctts")
+		}
+		for i := 0; i < count; i++ {
+			p := ctts.Payload[8+8*i:]
+			n := binary.BigEndian.Uint32(p[0:4])
+			o := int32(binary.BigEndian.Uint32(p[4:8]))
+			for j := uint32(0); j < n && len(offsets) < len(sizes); j++ {
+				offsets = append(offsets, o)
+			}
+		}
+	}
+
+	sample := 0
+	for r, run := range runs {
+		last := len(chunks)
+		if r+1 < len(runs) {
+			last = runs[r+1].firstChunk - 1
+		}
+		for c := run.firstChunk; c <= last && c >= 1 && c <= len(chunks); c++ {
+			offset := chunks[c-1]
+			for k := 0; k < run.perChunk && sample < len(sizes); k++ {
+				s := mp4Sample{offset: offset, size: sizes[sample], flags: sampleFlagsSync}
+				if sample < len(durations) {
+					s.duration = durations[sample]
+				}
+				if syncSamples != nil && !syncSamples[sample] {
+					s.flags = sampleFlagsNonSync
+				}
+				if sample < len(offsets) {
+					s.cto = offsets[sample]
+				}
+				t.samples = append(t.samples, s)
+				t.end += uint64(s.duration)
+				offset += int64(sizes[sample])
+				sample++
+			}
+		}
+	}
+	if sample != len(sizes) {
+		return fmt.Errorf("sample tables describe %d of %d samples", sample, len(sizes))
+	}
+	return nil
+}
+
+// readFragments appends the samples of every moof that belongs to the track.
+func (t *mp4Track) readFragments(boxes []bmff.Box, moov bmff.Box) error {
+	var defaults mp4Sample
+	for _, trex := range bmff.FindAll(moov.Children, "mvex", "trex") {
+		if p := trex.Payload; len(p) >= 24 && binary.BigEndian.Uint32(p[4:8]) == t.id {
+			defaults.duration = binary.BigEndian.Uint32(p[12:16])
+			defaults.size = int(binary.BigEndian.Uint32(p[16:20]))
+			defaults.flags = binary.BigEndian.Uint32(p[20:24])
+		}
+	}
+
+	for _, b := range boxes {
+		if b.Type != "moof" {
+			continue
+		}
+		moof, err := bmff.ParseMoof(b)
+		if err != nil {
+			return fmt.Errorf("moof at %d: %v", b.Offset, err)
+		}
+		for _, traf := range moof.Trafs {
+			if traf.Tfhd.TrackID == t.id {
+				t.readTraf(traf, b.Offset, defaults)
+			}
+		}
+	}
+	return nil
+}
+
+// readTraf appends the samples of one track fragment. defaults holds the
+// duration, size and flags given by trex.
+func (t *mp4Track) readTraf(traf bmff.Traf, moofOffset int64, defaults mp4Sample) {
+	if traf.Tfdt != nil {
+		switch tfdt := traf.Tfdt.BaseMediaDecodeTime; {
+		case len(t.samples) == 0:
+			t.baseTime, t.end = tfdt, tfdt
+		case tfdt != t.end:
+			t.gaps = append(t.gaps, mp4Gap{time: t.end, length: int64(tfdt - t.end)})
+			t.end = tfdt
+		}
+	}
+	t.fragmented = true
+
+	h := traf.Tfhd
+	base := moofOffset
+	if h.Flags&bmff.TfhdBaseDataOffset != 0 {
+		base = int64(h.BaseDataOffset)
+	}
+	if h.Flags&bmff.TfhdDefaultSampleDuration != 0 {
+		defaults.duration = h.DefaultSampleDuration
+	}
+	if h.Flags&bmff.TfhdDefaultSampleSize != 0 {
+		defaults.size = int(h.DefaultSampleSize)
+	}
+	if h.Flags&bmff.TfhdDefaultSampleFlags != 0 {
+		defaults.flags = h.DefaultSampleFlags
+	}
+
+	next := base
+	for _, trun := range traf.Truns {
+		offset := next
+		if trun.Flags&bmff.TrunDataOffset != 0 {
+			offset = base + int64(trun.DataOffset)
+		}
+
+		for i, e := range trun.Entries {
+			s := defaults
+			s.offset = offset
+			if i == 0 && trun.Flags&bmff.TrunFirstSampleFlags != 0 {
+				s.flags = trun.FirstSampleFlags
+			}
+			if trun.Flags&bmff.TrunSampleDuration != 0 {
+				s.duration = e.Duration
+			}
+			if trun.Flags&bmff.TrunSampleSize != 0 {
+				s.size = int(e.Size)
+			}
+			if trun.Flags&bmff.TrunSampleFlags != 0 {
+				s.flags = e.Flags
+			}
+			s.cto = e.CompositionOffset
+			t.samples = append(t.samples, s)
+			t.end += uint64(s.duration)
+			offset += int64(s.size)
+		}
+		next = offset
+	}
+}
+
+// sampleData returns the bytes of sample i.
+func (t *mp4Track) sampleData(buf []byte, i int) ([]byte, error) {
+	s := t.samples[i]
+	if s.offset < 0 || s.offset+int64(s.size) > int64(len(buf)) {
+		return nil, fmt.Errorf("sample %d lies outside the file", i+1)
+	}
+	return buf[s.offset : s.offset+int64(s.size)], nil
+}
@@ -2,20 +2,23 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/xml"
 	"fmt"
 	"io"
-	"math/big"
+	"log/slog"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"blurlconvert/bmff"
 )
 
 type PlaylistMetadata struct {
@@ -96,20 +99,26 @@ type MPD struct {
 					Value       string `xml:"value,attr"`
 				} `xml:"AudioChannelConfiguration"`
 			} `xml:"Representation"`
-			ContentProtection []struct {
-				Text        string `xml:",chardata"`
-				SchemeIdUri string `xml:"schemeIdUri,attr"`
-				Value       string `xml:"value,attr"`
-				DefaultKID  string `xml:"default_KID,attr"`
-				Laurl       struct {
-					Text    string `xml:",chardata"`
-					LicType string `xml:"Lic_type,attr"`
-				} `xml:"Laurl"`
-			} `xml:"ContentProtection"`
+			ContentProtection []contentProtection `xml:"ContentProtection"`
 		} `xml:"AdaptationSet"`
 	} `xml:"Period"`
 }
 
+type contentProtection struct {
+	Text        string `xml:",chardata"`
+	SchemeIdUri string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+	DefaultKID  string `xml:"default_KID,attr"`
+	Laurl       struct {
+		Text    string `xml:",chardata"`
+		LicType string `xml:"Lic_type,attr"`
+	} `xml:"Laurl"`
+	// Pssh holds base64 pssh boxes (cenc:pssh), Pro a base64 PlayReady
+	// object (mspr:pro).
+	Pssh []string `xml:"pssh"`
+	Pro  string   `xml:"pro"`
+}
+
 func isDirExists(path string) bool {
 	info, err := os.Stat(path)
 	if os.IsNotExist(err) {
@@ -133,27 +142,12 @@ func isFileValid(filepath string) bool {
 }
 
 const (
-	maxRetries = 3
-	retryDelay = 2 * time.Second
-	timeout    = 30 * time.Second
+	maxRetries         = 3
+	retryDelay         = 2 * time.Second
+	timeout            = 30 * time.Second
+	defaultConcurrency = 5
 )
 
-const base62 = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
-
-func EncodeToBase62(s string) string {
-	n := big.NewInt(0).SetBytes([]byte(s))
-	base := big.NewInt(62)
-	zero := big.NewInt(0)
-	mod := &big.Int{}
-
-	var result string
-	for n.Cmp(zero) != 0 {
-		n.DivMod(n, base, mod)
-		result = string(base62[mod.Int64()]) + result
-	}
-	return result
-}
-
 func getBaseURL(fullURL string) string {
 	parsedURL, err := url.Parse(fullURL)
 	if err != nil {
@@ -194,15 +188,22 @@ func RemoveDuplicateUUIDPath(inputURL string) (string, error) {
 }
 
 func GetPlaylistMetadataByID(url string) (*MPD, error) {
-	res, err := http.Get(url)
+	var body []byte
 
-	if err != nil {
-		return nil, err
-	}
+	err := defaultRetryPolicy.do(slog.With("url", url), func(attempt int) error {
+		res, err := httpClient.Get(url)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
 
-	defer res.Body.Close()
+		if err := checkStatus(res, http.StatusOK); err != nil {
+			return err
+		}
 
-	body, err := io.ReadAll(res.Body)
+		body, err = io.ReadAll(res.Body)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -221,86 +222,77 @@ func GetPlaylistDuration(mpddata *MPD) float64 {
 	duration, err := time.ParseDuration(strings.ToLower(strings.TrimPrefix(mpddata.MediaPresentationDuration, "PT")))
 
 	if err != nil {
-		fmt.Printf("failed to parse time duration: %s\n", err.Error())
+		slog.Warn("failed to parse time duration", "duration", mpddata.MediaPresentationDuration, "error", err)
 		return 0
 	}
 
 	return duration.Seconds()
 }
 
-func downloadWithRetry(url, filepath string) error {
-	client := &http.Client{
-		Timeout: timeout,
+func downloadWithRetry(ref trackRef, url, filepath string, validate func(path string) error) error {
+	log := ref.logger().With("url", url)
+	err := defaultRetryPolicy.do(log, func(attempt int) error {
+		return downloadOnce(ref, url, filepath, validate)
+	})
+	return withExit(exitNetwork, err)
+}
+
+func downloadOnce(ref trackRef, url, filepath string, validate func(path string) error) error {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
 	}
+	defer resp.Body.Close()
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		resp, err := client.Get(url)
-		if err != nil {
-			if attempt == maxRetries {
-				return fmt.Errorf("failed after %d attempts: %v", maxRetries, err)
-			}
-			time.Sleep(retryDelay * time.Duration(attempt))
-			continue
-		}
-		defer resp.Body.Close()
+	if err := checkStatus(resp, http.StatusOK); err != nil {
+		return err
+	}
 
-		if resp.StatusCode != http.StatusOK {
-			if attempt == maxRetries {
-				return fmt.Errorf("bad status after %d attempts: %s", maxRetries, resp.Status)
-			}
-			time.Sleep(retryDelay * time.Duration(attempt))
-			continue
-		}
+	tempFile := filepath + ".tmp"
+	out, err := os.Create(tempFile)
+	if err != nil {
+		return err
+	}
 
-		tempFile := filepath + ".tmp"
-		out, err := os.Create(tempFile)
-		if err != nil {
-			return err
-		}
+	n, err := io.Copy(out, &progressReader{r: resp.Body, ref: ref})
+	out.Close()
 
-		_, err = io.Copy(out, resp.Body)
-		out.Close()
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
 
-		if err != nil {
-			os.Remove(tempFile)
-			if attempt == maxRetries {
-				return err
-			}
-			time.Sleep(retryDelay * time.Duration(attempt))
-			continue
-		}
+	if resp.ContentLength >= 0 && n != resp.ContentLength {
+		os.Remove(tempFile)
+		return fmt.Errorf("%w: got %d bytes, Content-Length is %d", errIntegrity, n, resp.ContentLength)
+	}
 
-		if _, err := os.Stat(filepath); err == nil {
-			os.Remove(filepath)
-		}
+	if _, err := os.Stat(filepath); err == nil {
+		os.Remove(filepath)
+	}
 
-		err = os.Rename(tempFile, filepath)
+	err = os.Rename(tempFile, filepath)
+	if err != nil {
+		err = copyFile(tempFile, filepath)
+		os.Remove(tempFile)
 		if err != nil {
-			err = copyFile(tempFile, filepath)
-			if err != nil {
-				os.Remove(tempFile)
-				if attempt == maxRetries {
-					return fmt.Errorf("failed to create final file: %v", err)
-				}
-				time.Sleep(retryDelay * time.Duration(attempt))
-				continue
-			}
-			os.Remove(tempFile)
+			return fmt.Errorf("failed to create final file: %v", err)
 		}
+	}
 
-		if !isFileValid(filepath) {
+	if !isFileValid(filepath) {
+		os.Remove(filepath)
+		return errIntegrity
+	}
+
+	if validate != nil {
+		if err := validate(filepath); err != nil {
 			os.Remove(filepath)
-			if attempt == maxRetries {
-				return fmt.Errorf("file integrity check failed after %d attempts", maxRetries)
-			}
-			time.Sleep(retryDelay * time.Duration(attempt))
-			continue
+			return err
 		}
-
-		return nil
 	}
 
-	return fmt.Errorf("unknown error downloading %s", url)
+	return nil
 }
 
 func copyFile(src, dst string) error {
@@ -339,185 +331,320 @@ func parseByteRange(s string) (int64, int64, error) {
 	return a, b, nil
 }
 
-func httpRangeGet(u string, start, end int64) ([]byte, error) {
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+func httpRangeGet(ref trackRef, u string, start, end int64) ([]byte, error) {
+	var body []byte
 
-	client := &http.Client{Timeout: timeout}
-	res, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
+	log := ref.logger().With("url", u, "range", fmt.Sprintf("%d-%d", start, end))
+	err := defaultRetryPolicy.do(log, func(attempt int) error {
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
-	if res.StatusCode != http.StatusPartialContent && res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("bad status: %s", res.Status)
-	}
+		res, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
 
-	return io.ReadAll(res.Body)
-}
+		if err := checkStatus(res, http.StatusPartialContent, http.StatusOK); err != nil {
+			return err
+		}
 
-type sidxInfo struct {
-	firstOffset        uint64
-	referencedSizes    []uint32
-	sidxBoxSize        uint64
-	sidxBoxOffsetInBuf int64
-}
+		body, err = io.ReadAll(&progressReader{r: res.Body, ref: ref})
+		if err != nil {
+			return err
+		}
 
-func findAndParseSidx(buf []byte) (*sidxInfo, error) {
-	i := 0
-	for i+8 <= len(buf) {
-		size := binary.BigEndian.Uint32(buf[i : i+4])
-		typ := string(buf[i+4 : i+8])
-		var boxSize uint64
-		hdr := 8
-		if size == 1 {
-			if i+16 > len(buf) {
-				return nil, fmt.Errorf("invalid large size box")
-			}
-			boxSize = binary.BigEndian.Uint64(buf[i+8 : i+16])
-			hdr = 16
-		} else {
-			boxSize = uint64(size)
+		if res.StatusCode == http.StatusPartialContent && int64(len(body)) != end-start+1 {
+			return fmt.Errorf("%w: got %d bytes for range %d-%d", errIntegrity, len(body), start, end)
 		}
-		if boxSize < uint64(hdr) || i+int(boxSize) > len(buf) {
-			return nil, fmt.Errorf("invalid box size")
+		return nil
+	})
+
+	return body, withExit(exitNetwork, err)
+}
+
+func httpGet(ref trackRef, u string) ([]byte, error) {
+	var body []byte
+
+	err := defaultRetryPolicy.do(ref.logger().With("url", u), func(attempt int) error {
+		res, err := httpClient.Get(u)
+		if err != nil {
+			return err
 		}
-		if typ == "sidx" {
-			box := buf[i : i+int(boxSize)]
-			return parseSidxBox(box, int64(i), boxSize)
+		defer res.Body.Close()
+
+		if err := checkStatus(res, http.StatusOK); err != nil {
+			return err
 		}
-		i += int(boxSize)
-	}
-	return nil, fmt.Errorf("sidx not found")
+
+		body, err = io.ReadAll(&progressReader{r: res.Body, ref: ref})
+		return err
+	})
+
+	return body, withExit(exitNetwork, err)
 }
 
-func parseSidxBox(box []byte, off int64, boxSize uint64) (*sidxInfo, error) {
-	pos := 8
-	if binary.BigEndian.Uint32(box[0:4]) == 1 {
-		pos = 16
-	}
+// sidxSegment is one media segment of a SegmentBase representation, as
+// listed by its segment index.
+type sidxSegment struct {
+	offset    int64
+	size      int64
+	time      uint64
+	duration  uint64
+	timescale uint32
+	// startsWithSAP and sapType tell whether the segment starts at a stream
+	// access point, where decoding can begin.
+	startsWithSAP bool
+	sapType       uint8
+}
 
-	if pos+4 > len(box) {
-		return nil, fmt.Errorf("invalid sidx")
-	}
+// start and end are the presentation times of the segment in seconds.
+func (s sidxSegment) start() float64 { return float64(s.time) / float64(s.timescale) }
+func (s sidxSegment) end() float64   { return float64(s.time+s.duration) / float64(s.timescale) }
 
-	version := box[pos]
-	pos += 4
+// maxSidxDepth bounds how deep sidx boxes may reference each other, so that a
+// loop in a broken index ends with an error.
+const maxSidxDepth = 8
 
-	if pos+8 > len(box) {
-		return nil, fmt.Errorf("invalid sidx")
+// segmentsFromSegmentBase reads the sidx box in the index range of a
+// SegmentBase representation and returns its media segments. References to
+// other sidx boxes, as in hierarchical or daisy-chained indexes, are fetched
+// and resolved in place.
+func segmentsFromSegmentBase(ref trackRef, fullURL string, indexRange string) ([]sidxSegment, error) {
+	indexStart, indexEnd, err := parseByteRange(indexRange)
+	if err != nil {
+		return nil, err
+	}
+	idxBuf, err := httpRangeGet(ref, fullURL, indexStart, indexEnd)
+	if err != nil {
+		return nil, err
 	}
-	pos += 4
-	timescale := binary.BigEndian.Uint32(box[pos : pos+4])
-	_ = timescale
-	pos += 4
 
-	var earliest uint64
-	var firstOffset uint64
-	if version == 0 {
-		if pos+8 > len(box) {
-			return nil, fmt.Errorf("invalid sidx v0")
-		}
-		earliest = uint64(binary.BigEndian.Uint32(box[pos : pos+4]))
-		_ = earliest
-		pos += 4
-		firstOffset = uint64(binary.BigEndian.Uint32(box[pos : pos+4]))
-		pos += 4
-	} else {
-		if pos+16 > len(box) {
-			return nil, fmt.Errorf("invalid sidx v1")
+	boxes, err := bmff.Parse(idxBuf)
+	box, ok := bmff.Find(boxes, "sidx")
+	if !ok {
+		if err != nil {
+			return nil, fmt.Errorf("index range: %v", err)
 		}
-		earliest = binary.BigEndian.Uint64(box[pos : pos+8])
-		_ = earliest
-		pos += 8
-		firstOffset = binary.BigEndian.Uint64(box[pos : pos+8])
-		pos += 8
+		return nil, fmt.Errorf("sidx not found")
 	}
+	box.Offset += indexStart
+	return resolveSidx(ref, fullURL, box, 0)
+}
 
-	if pos+4 > len(box) {
-		return nil, fmt.Errorf("invalid sidx")
+// resolveSidx lists the segments of a sidx box whose Offset is its position
+// in the file.
+func resolveSidx(ref trackRef, fullURL string, box bmff.Box, depth int) ([]sidxSegment, error) {
+	sidx, err := bmff.ParseSidx(box)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sidx at offset %d: %v", box.Offset, err)
+	}
+	if sidx.Timescale == 0 {
+		return nil, fmt.Errorf("sidx at offset %d has timescale 0", box.Offset)
 	}
-	pos += 2
-	refCount := binary.BigEndian.Uint16(box[pos : pos+2])
-	pos += 2
 
-	sizes := make([]uint32, 0, refCount)
-	for j := 0; j < int(refCount); j++ {
-		if pos+12 > len(box) {
-			return nil, fmt.Errorf("invalid sidx refs")
+	var segments []sidxSegment
+	offset := box.Offset + box.Size + int64(sidx.FirstOffset)
+	pts := sidx.EarliestPresentationTime
+	for i, r := range sidx.References {
+		size := int64(r.ReferencedSize)
+		if r.ReferenceType == 1 {
+			if depth+1 >= maxSidxDepth {
+				return nil, fmt.Errorf("sidx at offset %d: index is nested more than %d levels deep", box.Offset, maxSidxDepth)
+			}
+			child, err := fetchSidx(ref, fullURL, offset, size)
+			if err != nil {
+				return nil, fmt.Errorf("sidx reference %d: %v", i+1, err)
+			}
+			nested, err := resolveSidx(ref, fullURL, child, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, nested...)
+		} else if size > 0 {
+			segments = append(segments, sidxSegment{
+				offset:        offset,
+				size:          size,
+				time:          pts,
+				duration:      uint64(r.SubsegmentDuration),
+				timescale:     sidx.Timescale,
+				startsWithSAP: r.StartsWithSAP,
+				sapType:       r.SAPType,
+			})
 		}
-		ref := binary.BigEndian.Uint32(box[pos : pos+4])
-		pos += 4
-		size := ref & 0x7FFFFFFF
-		sizes = append(sizes, size)
-		pos += 8
+		offset += size
+		pts += uint64(r.SubsegmentDuration)
 	}
-
-	return &sidxInfo{
-		firstOffset:        firstOffset,
-		referencedSizes:    sizes,
-		sidxBoxSize:        boxSize,
-		sidxBoxOffsetInBuf: off,
-	}, nil
+	return segments, nil
 }
 
-func countSegmentsFromSegmentBase(fullURL string, initRange string, indexRange string) (int, *sidxInfo, int64, error) {
-	indexStart, indexEnd, err := parseByteRange(indexRange)
+// fetchSidx downloads the sidx box at the start of a reference of size bytes.
+// The reference also covers the media that the box indexes, so its header is
+// read first to fetch no more than the box itself.
+func fetchSidx(ref trackRef, fullURL string, offset, size int64) (bmff.Box, error) {
+	if size < 8 {
+		return bmff.Box{}, fmt.Errorf("reference of %d bytes is too small for a sidx box", size)
+	}
+	head, err := httpRangeGet(ref, fullURL, offset, offset+min(size, 16)-1)
 	if err != nil {
-		return 0, nil, 0, err
+		return bmff.Box{}, err
 	}
-	idxBuf, err := httpRangeGet(fullURL, indexStart, indexEnd)
+	h, err := bmff.NewReader(bytes.NewReader(head)).Next()
 	if err != nil {
-		return 0, nil, 0, err
+		return bmff.Box{}, err
+	}
+	if h.Type != "sidx" {
+		return bmff.Box{}, fmt.Errorf("referenced %q box at offset %d, expected sidx", h.Type, offset)
+	}
+	if h.Size == 0 || h.Size > size {
+		return bmff.Box{}, fmt.Errorf("sidx at offset %d does not fit in its reference", offset)
 	}
 
-	sidx, err := findAndParseSidx(idxBuf)
+	buf, err := httpRangeGet(ref, fullURL, offset, offset+h.Size-1)
+	if err != nil {
+		return bmff.Box{}, err
+	}
+	boxes, err := bmff.Parse(buf)
 	if err != nil {
-		return 0, nil, 0, err
+		return bmff.Box{}, err
 	}
+	box := boxes[0]
+	box.Offset = offset
+	return box, nil
+}
 
-	sidxStartInFile := indexStart + sidx.sidxBoxOffsetInBuf
-	return len(sidx.referencedSizes), sidx, sidxStartInFile, nil
+type TrackDownload struct {
+	MediaType string
+	// Name tells the track apart in paths and file names: its media type,
+	// with the index of its adaptation set when other sets have that type.
+	Name             string
+	OutputPath       string
+	Segments         int
+	BaseURL          string
+	InitFile         string
+	RepresentationID string
+	Key              string
+	MediaTemplate    string
+	StartNumber      int
+	FullFileURL      string
+	InitRange        string
+	IndexRange       string
+	Concurrency      int
+	Job              string
+	Workspace        string
+	SampleRate       int
+	Channels         int
+	Codec            string
+	Bandwidth        int64
+	// SegmentDuration is the length in seconds of each SegmentTemplate
+	// segment, or 0 when the template gives none.
+	SegmentDuration float64
+	// Duration is the length in seconds the exported audio is trimmed to, or
+	// 0 to keep all of it.
+	Duration float64
+	// Clip is the part of the song to download. Only the segments that
+	// overlap it are fetched.
+	Clip timeRange
+	// Start is the song time in seconds of the first downloaded segment, set
+	// by HandleDownloadTrack.
+	Start float64
+	// Tags are written into the exported files.
+	Tags []tag
 }
 
-func HandleDownloadTrack(mediatype string, id string, numberofsegments float64, baseurl string, initmp4 string, adaptation string, key string, mediaTemplate string, startNumber int, fullFileURL string, initRange string, indexRange string) error {
-	if !isDirExists("downloads") {
-		err := os.Mkdir("downloads", 0755)
+// fetchInit downloads the init segment of a track into memory. It returns
+// nil for a track that is one file without an index, whose init segment
+// cannot be told apart from its media.
+func (t TrackDownload) fetchInit(ref trackRef) ([]byte, error) {
+	switch {
+	case t.MediaTemplate == "" && t.FullFileURL != "" && t.InitRange != "":
+		start, end, err := parseByteRange(t.InitRange)
 		if err != nil {
-			return fmt.Errorf("error creating downloads directory: %v", err)
+			return nil, err
 		}
+		return httpRangeGet(ref, t.FullFileURL, start, end)
+	case t.MediaTemplate != "":
+		return httpGet(ref, t.BaseURL+t.InitFile)
+	}
+	return nil, nil
+}
+
+// templateRange is the index of the first SegmentTemplate segment to download
+// and the index after the last one.
+func (t TrackDownload) templateRange() (int, int) {
+	first, last := 0, t.Segments
+	if !t.Clip.set() || t.SegmentDuration <= 0 {
+		return first, last
+	}
+	first = int(max(t.Clip.start-clipPreroll, 0) / t.SegmentDuration)
+	if t.Clip.end > 0 {
+		last = min(last, int(math.Ceil((t.Clip.end+clipPreroll)/t.SegmentDuration)))
 	}
+	return first, max(first, last)
+}
+
+// noSegments is the error for a track with nothing to download.
+func (t TrackDownload) noSegments() error {
+	if t.Clip.set() {
+		return fmt.Errorf("no segments cover %s", t.Clip)
+	}
+	return fmt.Errorf("manifest lists no segments")
+}
+
+func HandleDownloadTrack(t *TrackDownload) error {
+	ref := trackRef{Job: t.Job, Track: t.Name}
+	log := ref.logger()
 
-	if mediaTemplate == "" && initRange != "" && indexRange != "" && fullFileURL != "" {
-		count, sidx, sidxStart, err := countSegmentsFromSegmentBase(fullFileURL, initRange, indexRange)
+	if !isDirExists(t.Workspace) {
+		return fmt.Errorf("workspace %s does not exist", t.Workspace)
+	}
+
+	if t.MediaTemplate == "" && t.InitRange != "" && t.IndexRange != "" && t.FullFileURL != "" {
+		segments, err := segmentsFromSegmentBase(ref, t.FullFileURL, t.IndexRange)
 		if err != nil {
 			return err
 		}
+		if t.Clip.set() {
+			var clipped []sidxSegment
+			for _, seg := range segments {
+				if t.Clip.overlaps(seg.start(), seg.end()) {
+					clipped = append(clipped, seg)
+				}
+			}
+			segments = clipped
+		}
+		count := len(segments)
+		if count == 0 {
+			return t.noSegments()
+		}
+		t.Start = segments[0].start()
 
-		fmt.Printf("===================================================================================\n")
-		fmt.Printf("Track Segments: %d\n", count)
-		fmt.Printf("Media Type: %s\n", mediatype)
-		fmt.Printf("===================================================================================\n")
+		log.Info("downloading track segments", "segments", count, "url", t.FullFileURL)
 
-		localName := fmt.Sprintf("%s.mp4", id)
-		initPath := fmt.Sprintf("./downloads/%s", localName)
+		initPath := filepath.Join(t.Workspace, fmt.Sprintf("master_%s.mp4", t.Name))
 
 		os.Remove(initPath)
 
-		initStart, initEnd, err := parseByteRange(initRange)
+		initStart, initEnd, err := parseByteRange(t.InitRange)
 		if err != nil {
 			return err
 		}
 
-		initBytes, err := httpRangeGet(fullFileURL, initStart, initEnd)
+		ref.report(ProgressEvent{Stage: stageDownload, Status: eventStart, Total: count, URL: t.FullFileURL})
+
+		initBytes, err := httpRangeGet(ref, t.FullFileURL, initStart, initEnd)
 		if err != nil {
 			return err
 		}
 
+		boxes, _ := bmff.Parse(initBytes)
+		if _, ok := bmff.Find(boxes, "moov"); !ok {
+			return fmt.Errorf("%w: init range has no moov", errIntegrity)
+		}
+
 		err = os.WriteFile(initPath, initBytes, 0644)
 		if err != nil {
 			return err
@@ -529,35 +656,36 @@ func HandleDownloadTrack(mediatype string, id string, numberofsegments float64,
 		}
 		defer f.Close()
 
-		segStart := sidxStart + int64(sidx.sidxBoxSize) + int64(sidx.firstOffset)
+		var seq tfdtSequence
 
-		for i := 0; i < len(sidx.referencedSizes); i++ {
-			sz := int64(sidx.referencedSizes[i])
-			if sz <= 0 {
-				break
-			}
-			segEnd := segStart + sz - 1
-			b, err := httpRangeGet(fullFileURL, segStart, segEnd)
+		for i, seg := range segments {
+			b, err := httpRangeGet(ref, t.FullFileURL, seg.offset, seg.offset+seg.size-1)
 			if err != nil {
 				return err
 			}
+			info, err := validateSegment(b, seg.size)
+			if err != nil {
+				return withExit(exitNetwork, fmt.Errorf("segment %d: %w", i+1, err))
+			}
+			if err := seq.check(i+1, info); err != nil {
+				return withExit(exitNetwork, err)
+			}
+			ref.report(ProgressEvent{Stage: stageSegment, Status: eventDone, Segment: i + 1, Total: count})
 			_, err = io.Copy(f, bytes.NewReader(b))
 			if err != nil {
 				return err
 			}
-			segStart = segEnd + 1
 		}
 
-		if len(key) > 0 {
-			cmd := exec.Command("ffmpeg", "-decryption_key", key, "-i", initPath, "-c", "copy", fmt.Sprintf("%s.mp4", id))
-			err := cmd.Run()
+		if len(t.Key) > 0 {
+			f.Close()
+			err := DecryptPlaylist(ref, initPath, t.OutputPath, t.Key)
 			if err != nil {
 				return err
 			}
 		} else {
-			finalPath := fmt.Sprintf("master_%s.mp4", mediatype)
-			os.Remove(finalPath)
-			err = copyFile(initPath, finalPath)
+			os.Remove(t.OutputPath)
+			err = copyFile(initPath, t.OutputPath)
 			if err != nil {
 				return err
 			}
@@ -566,31 +694,41 @@ func HandleDownloadTrack(mediatype string, id string, numberofsegments float64,
 		return nil
 	}
 
-	segmentCount := int(numberofsegments)
+	first, last := t.templateRange()
+	segmentCount := last - first
+	if t.MediaTemplate != "" && segmentCount == 0 {
+		return t.noSegments()
+	}
+	t.Start = float64(first) * t.SegmentDuration
 
-	fmt.Printf("Downloading init file: %s%s\n", baseurl, initmp4)
+	log.Info("downloading init file", "url", t.BaseURL+t.InitFile)
 
-	initPath := fmt.Sprintf("./downloads/%s", initmp4)
+	initPath := filepath.Join(t.Workspace, path.Base(t.InitFile))
 
 	if _, err := os.Stat(initPath); err == nil {
 		os.Remove(initPath)
 	}
 
-	err := downloadWithRetry(fmt.Sprintf("%s%s", baseurl, initmp4), initPath)
+	total := segmentCount
+	if t.MediaTemplate == "" {
+		total = 0
+	}
+	ref.report(ProgressEvent{Stage: stageDownload, Status: eventStart, Total: total, URL: t.BaseURL + t.InitFile})
+
+	err := downloadWithRetry(ref, fmt.Sprintf("%s%s", t.BaseURL, t.InitFile), initPath, validateInitFile)
 	if err != nil {
-		return fmt.Errorf("error downloading init track: %v", err)
+		return fmt.Errorf("error downloading init track: %w", err)
 	}
 
-	if mediaTemplate == "" {
-		if len(key) > 0 {
-			DecryptPlaylist(id, initmp4, key)
+	if t.MediaTemplate == "" {
+		if len(t.Key) > 0 {
+			return DecryptPlaylist(ref, initPath, t.OutputPath, t.Key)
 		} else {
-			finalPath := fmt.Sprintf("master_%s.mp4", mediatype)
-			if _, err := os.Stat(finalPath); err == nil {
-				os.Remove(finalPath)
+			if _, err := os.Stat(t.OutputPath); err == nil {
+				os.Remove(t.OutputPath)
 			}
 
-			err = copyFile(initPath, finalPath)
+			err = copyFile(initPath, t.OutputPath)
 			if err != nil {
 				return fmt.Errorf("error creating final file: %v", err)
 			}
@@ -607,9 +745,13 @@ func HandleDownloadTrack(mediatype string, id string, numberofsegments float64,
 	var wg sync.WaitGroup
 	errChan := make(chan error, segmentCount)
 	files := make([]string, segmentCount)
-	semaphore := make(chan struct{}, 5)
+	concurrency := t.Concurrency
+	if concurrency <= 0 {
+		concurrency = defaultConcurrency
+	}
+	semaphore := make(chan struct{}, concurrency)
 
-	fmt.Printf("Downloading %d segments...\n", segmentCount)
+	log.Info("downloading segments", "segments", segmentCount)
 
 	for idx := 0; idx < segmentCount; idx++ {
 		wg.Add(1)
@@ -618,24 +760,30 @@ func HandleDownloadTrack(mediatype string, id string, numberofsegments float64,
 			semaphore <- struct{}{}
 			defer func() { <-semaphore }()
 
-			segNumber := startNumber + index
-			segName := strings.ReplaceAll(mediaTemplate, "$RepresentationID$", adaptation)
+			segNumber := t.StartNumber + first + index
+			segName := strings.ReplaceAll(t.MediaTemplate, "$RepresentationID$", t.RepresentationID)
 			segName = strings.ReplaceAll(segName, "$Number$", strconv.Itoa(segNumber))
 
-			segURL := fmt.Sprintf("%s%s", baseurl, segName)
-			filename := segName
+			segURL := fmt.Sprintf("%s%s", t.BaseURL, segName)
+			filename := path.Base(segName)
 
-			filePath := fmt.Sprintf("./downloads/%s", filename)
+			filePath := filepath.Join(t.Workspace, filename)
 
 			if _, err := os.Stat(filePath); err == nil {
 				os.Remove(filePath)
 			}
 
-			err := downloadWithRetry(segURL, filePath)
+			err := downloadWithRetry(ref, segURL, filePath, func(path string) error {
+				_, err := validateSegmentFile(path, 0)
+				return err
+			})
 			if err != nil {
+				ref.report(ProgressEvent{Stage: stageSegment, Status: eventError, Segment: index + 1, Total: segmentCount, URL: segURL, Error: err.Error()})
+				log.Error("error downloading segment", "segment", segNumber, "url", segURL, "error", err)
 				errChan <- fmt.Errorf("error downloading segment %d: %v", segNumber, err)
 				return
 			}
+			ref.report(ProgressEvent{Stage: stageSegment, Status: eventDone, Segment: index + 1, Total: segmentCount, URL: segURL})
 
 			files[index] = filename
 		}(idx)
@@ -644,41 +792,49 @@ func HandleDownloadTrack(mediatype string, id string, numberofsegments float64,
 	wg.Wait()
 	close(errChan)
 
+	failed := 0
 	for err := range errChan {
 		if err != nil {
-			fmt.Println(err.Error())
+			failed++
 		}
 	}
 
-	for _, filename := range files {
-		if filename == "" {
-			continue
-		}
+	if failed > 0 {
+		return withExit(exitNetwork, fmt.Errorf("%d of %d segments failed to download", failed, segmentCount))
+	}
 
-		filePath := fmt.Sprintf("./downloads/%s", filename)
-		file, err := os.Open(filePath)
+	var seq tfdtSequence
+	for index, filename := range files {
+		filePath := filepath.Join(t.Workspace, filename)
+		b, err := os.ReadFile(filePath)
 		if err != nil {
-			continue
+			return err
 		}
-
-		_, err = io.Copy(mastertrack, file)
-		file.Close()
 		os.Remove(filePath)
 
+		info, err := validateSegment(b, 0)
 		if err != nil {
-			continue
+			return withExit(exitNetwork, fmt.Errorf("segment %d: %w", t.StartNumber+first+index, err))
+		}
+		if err := seq.check(t.StartNumber+first+index, info); err != nil {
+			return withExit(exitNetwork, err)
+		}
+
+		_, err = mastertrack.Write(b)
+		if err != nil {
+			return fmt.Errorf("error writing master track: %v", err)
 		}
 	}
 
-	if len(key) > 0 {
-		DecryptPlaylist(id, initmp4, key)
+	if len(t.Key) > 0 {
+		mastertrack.Close()
+		return DecryptPlaylist(ref, initPath, t.OutputPath, t.Key)
 	} else {
-		finalPath := fmt.Sprintf("master_%s.mp4", mediatype)
-		if _, err := os.Stat(finalPath); err == nil {
-			os.Remove(finalPath)
+		if _, err := os.Stat(t.OutputPath); err == nil {
+			os.Remove(t.OutputPath)
 		}
 
-		err = copyFile(initPath, finalPath)
+		err = copyFile(initPath, t.OutputPath)
 		if err != nil {
 			return fmt.Errorf("error creating final file: %v", err)
 		}
@@ -687,34 +843,17 @@ func HandleDownloadTrack(mediatype string, id string, numberofsegments float64,
 	return nil
 }
 
-func DecryptPlaylist(id string, initmp4 string, key string) {
-	cmd := exec.Command("ffmpeg", "-decryption_key", key, "-i", fmt.Sprintf("./downloads/%s", initmp4), "-c", "copy", fmt.Sprintf("%s.mp4", id))
+func DecryptPlaylist(ref trackRef, src string, dst string, key string) error {
+	ref.report(ProgressEvent{Stage: stageDecrypt, Status: eventStart})
 
-	err := cmd.Run()
-	if err != nil {
-		fmt.Println("Error running ffmpeg command:", err)
-		return
-	}
-}
-
-func Merge(videofile string, audiofile string, kid string) {
-	cmd := exec.Command("ffmpeg", "-i", videofile, "-i", audiofile, "-c:v", "copy", "-c:a", "copy", fmt.Sprintf("%s_master.mp4", kid))
+	cmd := exec.Command("ffmpeg", "-y", "-decryption_key", key, "-i", src, "-c", "copy", dst)
 
 	err := cmd.Run()
 	if err != nil {
-		fmt.Println("Error running ffmpeg command:", err)
-		return
-	}
-
-	err = os.Remove(videofile)
-	if err != nil {
-		fmt.Println("Error deleting video file:", err)
-		return
+		ref.reportError(stageDecrypt, err)
+		return withExit(exitDecrypt, fmt.Errorf("error running ffmpeg decrypt: %v", err))
 	}
 
-	err = os.Remove(audiofile)
-	if err != nil {
-		fmt.Println("Error deleting audio file:", err)
-		return
-	}
+	ref.report(ProgressEvent{Stage: stageDecrypt, Status: eventDone})
+	return nil
 }
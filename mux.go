@@ -0,0 +1,727 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+
+	"blurlconvert/bmff"
+)
+
+// Progressive files interleave chunks of about a second per track, fragmented
+// files get a fragment every two seconds.
+const (
+	muxChunkSeconds    = 1
+	muxFragmentSeconds = 2
+)
+
+// Merge combines the tracks of several decrypted MP4 files into one. The result
+// is fragmented when all inputs are, unless defragment is set, and a
+// progressive MP4 otherwise.
+func Merge(ref trackRef, inputs []string, output string, defragment bool, tags []tag) error {
+	ref.report(ProgressEvent{Stage: stageMerge, Status: eventStart})
+
+	if err := writeMP4(inputs, output, defragment, tags); err != nil {
+		ref.reportError(stageMerge, err)
+		return withExit(exitMux, fmt.Errorf("error merging tracks: %v", err))
+	}
+
+	ref.report(ProgressEvent{Stage: stageMerge, Status: eventDone})
+	return nil
+}
+
+// writeMP4 muxes the tracks of its inputs into dst with tags in its moov. A
+// single input is rewritten to tag or defragment it.
+func writeMP4(inputs []string, dst string, defragment bool, tags []tag) error {
+	m, err := newMP4Muxer(inputs)
+	if err != nil {
+		return err
+	}
+	m.tags = tags
+	if m.fragmented() && !defragment {
+		return m.writeFragmented(dst)
+	}
+	return m.writeProgressive(dst)
+}
+
+// muxTrack is an input track and the file its samples are read from.
+type muxTrack struct {
+	*mp4Track
+	buf []byte
+	id  uint32
+	// edit replaces the edit list of the input when set, in the timescale of
+	// the merged movie.
+	edit *mp4Edit
+}
+
+// mp4Muxer writes the tracks of its inputs into one file. Sample entries,
+// media timescales and edit lists are kept as they are; track IDs are
+// renumbered from 1.
+type mp4Muxer struct {
+	tracks         []*muxTrack
+	movieTimescale uint32
+	// tags are written to the moov's udta.
+	tags []tag
+}
+
+func newMP4Muxer(inputs []string) (*mp4Muxer, error) {
+	m := &mp4Muxer{}
+	for _, input := range inputs {
+		buf, err := os.ReadFile(input)
+		if err != nil {
+			return nil, err
+		}
+		tracks, err := readTracks(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", input, err)
+		}
+		for _, t := range tracks {
+			m.tracks = append(m.tracks, &muxTrack{mp4Track: t, buf: buf, id: uint32(len(m.tracks) + 1)})
+		}
+	}
+	if len(m.tracks) == 0 {
+		return nil, fmt.Errorf("no tracks to merge")
+	}
+	m.movieTimescale = m.tracks[0].movieTimescale
+	return m, nil
+}
+
+func (m *mp4Muxer) fragmented() bool {
+	for _, t := range m.tracks {
+		if !t.fragmented {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *mp4Track) mediaDuration() uint64 {
+	var d uint64
+	for _, s := range t.samples {
+		d += uint64(s.duration)
+	}
+	return d
+}
+
+// mp4Edit is one entry of an edit list.
+type mp4Edit struct {
+	duration  uint64
+	mediaTime int64
+	rate      uint32
+}
+
+// edits returns the edit list of a track with its durations in the timescale
+// of the merged movie.
+func (m *mp4Muxer) edits(t *muxTrack) []mp4Edit {
+	if t.edit != nil {
+		return []mp4Edit{*t.edit}
+	}
+	elst, ok := t.trak.Find("edts", "elst")
+	if !ok || len(elst.Payload) < 8 {
+		return nil
+	}
+	p := elst.Payload
+	count := int(binary.BigEndian.Uint32(p[4:8]))
+	size := 12
+	if p[0] == 1 {
+		size = 20
+	}
+
+	var edits []mp4Edit
+	for i := 0; i < count && 8+(i+1)*size <= len(p); i++ {
+		e := p[8+i*size:]
+		var edit mp4Edit
+		if p[0] == 1 {
+			edit = mp4Edit{binary.BigEndian.Uint64(e[0:8]), int64(binary.BigEndian.Uint64(e[8:16])), binary.BigEndian.Uint32(e[16:20])}
+		} else {
+			edit = mp4Edit{uint64(binary.BigEndian.Uint32(e[0:4])), int64(int32(binary.BigEndian.Uint32(e[4:8]))), binary.BigEndian.Uint32(e[8:12])}
+		}
+		edit.duration = edit.duration * uint64(m.movieTimescale) / uint64(t.movieTimescale)
+		edits = append(edits, edit)
+	}
+	return edits
+}
+
+// trackDuration is the length of a track in the timescale of the merged
+// movie, after its edit list.
+func (m *mp4Muxer) trackDuration(t *muxTrack) uint64 {
+	var d uint64
+	for _, e := range m.edits(t) {
+		d += e.duration
+	}
+	if d == 0 {
+		d = t.mediaDuration() * uint64(m.movieTimescale) / uint64(t.timescale)
+	}
+	return d
+}
+
+func (m *mp4Muxer) movieDuration() uint64 {
+	var d uint64
+	for _, t := range m.tracks {
+		d = max(d, m.trackDuration(t))
+	}
+	return d
+}
+
+// muxChunk is a run of samples of one track stored together in the mdat of a
+// progressive file.
+type muxChunk struct {
+	track  *muxTrack
+	first  int
+	count  int
+	start  float64
+	size   int64
+	offset int64
+}
+
+// chunks splits every track into chunks and orders them by time, so that the
+// tracks are interleaved.
+func (m *mp4Muxer) chunks() []muxChunk {
+	var chunks []muxChunk
+	for _, t := range m.tracks {
+		var dts uint64
+		var c *muxChunk
+		for i, s := range t.samples {
+			start := float64(dts) / float64(t.timescale)
+			if c == nil || start-c.start >= muxChunkSeconds {
+				chunks = append(chunks, muxChunk{track: t, first: i, start: start})
+				c = &chunks[len(chunks)-1]
+			}
+			c.count++
+			c.size += int64(s.size)
+			dts += uint64(s.duration)
+		}
+	}
+	slices.SortStableFunc(chunks, func(a, b muxChunk) int {
+		switch {
+		case a.start < b.start:
+			return -1
+		case a.start > b.start:
+			return 1
+		}
+		return 0
+	})
+	return chunks
+}
+
+// writeProgressive writes a classic MP4: ftyp, then a moov with full sample
+// tables, then a single mdat.
+func (m *mp4Muxer) writeProgressive(dst string) error {
+	chunks := m.chunks()
+	var dataSize int64
+	for _, c := range chunks {
+		dataSize += c.size
+	}
+
+	ftyp := ftypBox("isom", "iso2", "mp41")
+	mdatHeader := 8
+	if dataSize+8 > math.MaxUint32 {
+		mdatHeader = 16
+	}
+
+	// Chunk offsets do not change the size of the moov, so it is built once to
+	// find where the samples start and once more with the real offsets.
+	co64 := false
+	moov, err := m.progressiveMoov(chunks, co64)
+	if err != nil {
+		return err
+	}
+	if int64(len(ftyp)+len(moov)+mdatHeader)+dataSize > math.MaxUint32 {
+		co64 = true
+		if moov, err = m.progressiveMoov(chunks, co64); err != nil {
+			return err
+		}
+	}
+	pos := int64(len(ftyp) + len(moov) + mdatHeader)
+	for i := range chunks {
+		chunks[i].offset = pos
+		pos += chunks[i].size
+	}
+	if moov, err = m.progressiveMoov(chunks, co64); err != nil {
+		return err
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	w.Write(ftyp)
+	w.Write(moov)
+	if mdatHeader == 16 {
+		w.Write(binary.BigEndian.AppendUint32(nil, 1))
+		w.WriteString("mdat")
+		w.Write(binary.BigEndian.AppendUint64(nil, uint64(dataSize+16)))
+	} else {
+		w.Write(binary.BigEndian.AppendUint32(nil, uint32(dataSize+8)))
+		w.WriteString("mdat")
+	}
+	for _, c := range chunks {
+		if err := c.track.writeSamples(w, c.first, c.count); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (t *muxTrack) writeSamples(w io.Writer, first, count int) error {
+	for i := first; i < first+count; i++ {
+		data, err := t.sampleData(t.buf, i)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *mp4Muxer) progressiveMoov(chunks []muxChunk, co64 bool) ([]byte, error) {
+	parts := [][]byte{mvhdBox(m.movieTimescale, m.movieDuration(), uint32(len(m.tracks)+1))}
+	for _, t := range m.tracks {
+		var own []muxChunk
+		for _, c := range chunks {
+			if c.track == t {
+				own = append(own, c)
+			}
+		}
+		stbl, err := t.progressiveStbl(own, co64)
+		if err != nil {
+			return nil, err
+		}
+		trak, err := m.trak(t, stbl, m.trackDuration(t), t.mediaDuration())
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, trak)
+	}
+	if len(m.tags) > 0 {
+		parts = append(parts, udtaBox(m.tags))
+	}
+	return bmff.Encode("moov", parts...), nil
+}
+
+// progressiveStbl builds the sample tables of a track stored in chunks.
+func (t *muxTrack) progressiveStbl(chunks []muxChunk, co64 bool) ([]byte, error) {
+	stsd, err := t.stsd()
+	if err != nil {
+		return nil, err
+	}
+	parts := [][]byte{stsd}
+
+	var stts []byte
+	var runs uint32
+	for i := 0; i < len(t.samples); {
+		j := i
+		for j < len(t.samples) && t.samples[j].duration == t.samples[i].duration {
+			j++
+		}
+		stts = binary.BigEndian.AppendUint32(stts, uint32(j-i))
+		stts = binary.BigEndian.AppendUint32(stts, t.samples[i].duration)
+		runs++
+		i = j
+	}
+	parts = append(parts, bmff.EncodeFull("stts", 0, 0, binary.BigEndian.AppendUint32(nil, runs), stts))
+
+	if slices.ContainsFunc(t.samples, func(s mp4Sample) bool { return s.cto != 0 }) {
+		version := byte(0)
+		if slices.ContainsFunc(t.samples, func(s mp4Sample) bool { return s.cto < 0 }) {
+			version = 1
+		}
+		var ctts []byte
+		runs = 0
+		for i := 0; i < len(t.samples); {
+			j := i
+			for j < len(t.samples) && t.samples[j].cto == t.samples[i].cto {
+				j++
+			}
+			ctts = binary.BigEndian.AppendUint32(ctts, uint32(j-i))
+			ctts = binary.BigEndian.AppendUint32(ctts, uint32(t.samples[i].cto))
+			runs++
+			i = j
+		}
+		parts = append(parts, bmff.EncodeFull("ctts", version, 0, binary.BigEndian.AppendUint32(nil, runs), ctts))
+	}
+
+	if slices.ContainsFunc(t.samples, func(s mp4Sample) bool { return !s.sync() }) {
+		var stss []byte
+		var count uint32
+		for i, s := range t.samples {
+			if s.sync() {
+				stss = binary.BigEndian.AppendUint32(stss, uint32(i+1))
+				count++
+			}
+		}
+		parts = append(parts, bmff.EncodeFull("stss", 0, 0, binary.BigEndian.AppendUint32(nil, count), stss))
+	}
+
+	var stsc []byte
+	runs = 0
+	for i, c := range chunks {
+		if i > 0 && chunks[i-1].count == c.count {
+			continue
+		}
+		stsc = binary.BigEndian.AppendUint32(stsc, uint32(i+1))
+		stsc = binary.BigEndian.AppendUint32(stsc, uint32(c.count))
+		stsc = binary.BigEndian.AppendUint32(stsc, 1)
+		runs++
+	}
+	parts = append(parts, bmff.EncodeFull("stsc", 0, 0, binary.BigEndian.AppendUint32(nil, runs), stsc))
+
+	parts = append(parts, stszBox(t.samples))
+
+	var offsets []byte
+	for _, c := range chunks {
+		if co64 {
+			offsets = binary.BigEndian.AppendUint64(offsets, uint64(c.offset))
+		} else {
+			offsets = binary.BigEndian.AppendUint32(offsets, uint32(c.offset))
+		}
+	}
+	typ := "stco"
+	if co64 {
+		typ = "co64"
+	}
+	parts = append(parts, bmff.EncodeFull(typ, 0, 0, binary.BigEndian.AppendUint32(nil, uint32(len(chunks))), offsets))
+
+	return bmff.Encode("stbl", parts...), nil
+}
+
+func stszBox(samples []mp4Sample) []byte {
+	fixed := samples[0].size
+	for _, s := range samples {
+		if s.size != fixed {
+			fixed = 0
+			break
+		}
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(fixed))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(samples)))
+	if fixed == 0 {
+		for _, s := range samples {
+			b = binary.BigEndian.AppendUint32(b, uint32(s.size))
+		}
+	}
+	return bmff.EncodeFull("stsz", 0, 0, b)
+}
+
+// writeFragmented writes an init segment (ftyp and a moov without samples)
+// followed by moof and mdat pairs.
+func (m *mp4Muxer) writeFragmented(dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	w.Write(ftypBox("isom", "iso6", "mp41"))
+	moov, err := m.fragmentedMoov()
+	if err != nil {
+		return err
+	}
+	w.Write(moov)
+
+	next := make([]int, len(m.tracks))
+	dts := make([]uint64, len(m.tracks))
+	sequence := uint32(1)
+	for window := 1; ; window++ {
+		limit := float64(window * muxFragmentSeconds)
+		var runs []muxChunk
+		var bases []uint64
+		left := false
+		for i, t := range m.tracks {
+			c := muxChunk{track: t, first: next[i]}
+			base := dts[i]
+			for next[i] < len(t.samples) && float64(dts[i])/float64(t.timescale) < limit {
+				c.count++
+				c.size += int64(t.samples[next[i]].size)
+				dts[i] += uint64(t.samples[next[i]].duration)
+				next[i]++
+			}
+			if c.count > 0 {
+				runs = append(runs, c)
+				bases = append(bases, base)
+			}
+			if next[i] < len(t.samples) {
+				left = true
+			}
+		}
+		if len(runs) > 0 {
+			if err := writeFragment(w, sequence, runs, bases); err != nil {
+				return err
+			}
+			sequence++
+		}
+		if !left {
+			break
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeFragment(w io.Writer, sequence uint32, runs []muxChunk, bases []uint64) error {
+	// Data offsets count from the start of the moof, whose size does not
+	// depend on them.
+	moof := moofBox(sequence, runs, bases, 0)
+	moof = moofBox(sequence, runs, bases, len(moof)+8)
+
+	var size int64
+	for _, r := range runs {
+		size += r.size
+	}
+	if size+8 > math.MaxUint32 {
+		return fmt.Errorf("fragment %d is too large", sequence)
+	}
+
+	if _, err := w.Write(moof); err != nil {
+		return err
+	}
+	header := binary.BigEndian.AppendUint32(nil, uint32(size+8))
+	if _, err := w.Write(append(header, "mdat"...)); err != nil {
+		return err
+	}
+	for _, r := range runs {
+		if err := r.track.writeSamples(w, r.first, r.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moofBox(sequence uint32, runs []muxChunk, bases []uint64, dataOffset int) []byte {
+	parts := [][]byte{bmff.EncodeFull("mfhd", 0, 0, binary.BigEndian.AppendUint32(nil, sequence))}
+	for i, r := range runs {
+		samples := r.track.samples[r.first : r.first+r.count]
+
+		trun := &bmff.Trun{
+			Flags:      bmff.TrunDataOffset | bmff.TrunSampleDuration | bmff.TrunSampleSize | bmff.TrunSampleFlags,
+			DataOffset: int32(dataOffset),
+		}
+		if slices.ContainsFunc(samples, func(s mp4Sample) bool { return s.cto != 0 }) {
+			trun.Flags |= bmff.TrunSampleCompositionTime
+		}
+		if slices.ContainsFunc(samples, func(s mp4Sample) bool { return s.cto < 0 }) {
+			trun.Version = 1
+		}
+		for _, s := range samples {
+			trun.Entries = append(trun.Entries, bmff.TrunEntry{
+				Duration:          s.duration,
+				Size:              uint32(s.size),
+				Flags:             s.flags,
+				CompositionOffset: s.cto,
+			})
+		}
+		dataOffset += int(r.size)
+
+		tfhd := &bmff.Tfhd{Flags: bmff.TfhdDefaultBaseIsMoof, TrackID: r.track.id}
+		tfdt := &bmff.Tfdt{Version: 1, BaseMediaDecodeTime: bases[i]}
+		parts = append(parts, bmff.Encode("traf", tfhd.Encode(), tfdt.Encode(), trun.Encode()))
+	}
+	return bmff.Encode("moof", parts...)
+}
+
+func (m *mp4Muxer) fragmentedMoov() ([]byte, error) {
+	parts := [][]byte{mvhdBox(m.movieTimescale, 0, uint32(len(m.tracks)+1))}
+	mvex := [][]byte{bmff.EncodeFull("mehd", 1, 0, binary.BigEndian.AppendUint64(nil, m.movieDuration()))}
+
+	for _, t := range m.tracks {
+		stsd, err := t.stsd()
+		if err != nil {
+			return nil, err
+		}
+		empty := binary.BigEndian.AppendUint32(nil, 0)
+		stbl := bmff.Encode("stbl",
+			stsd,
+			bmff.EncodeFull("stts", 0, 0, empty),
+			bmff.EncodeFull("stsc", 0, 0, empty),
+			bmff.EncodeFull("stsz", 0, 0, empty, empty),
+			bmff.EncodeFull("stco", 0, 0, empty))
+		trak, err := m.trak(t, stbl, 0, 0)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, trak)
+
+		trex := binary.BigEndian.AppendUint32(nil, t.id)
+		trex = binary.BigEndian.AppendUint32(trex, 1)
+		trex = binary.BigEndian.AppendUint32(trex, 0)
+		trex = binary.BigEndian.AppendUint32(trex, 0)
+		trex = binary.BigEndian.AppendUint32(trex, 0)
+		mvex = append(mvex, bmff.EncodeFull("trex", 0, 0, trex))
+	}
+
+	parts = append(parts, bmff.Encode("mvex", mvex...))
+	if len(m.tags) > 0 {
+		parts = append(parts, udtaBox(m.tags))
+	}
+	return bmff.Encode("moov", parts...), nil
+}
+
+// trak copies the trak box of an input track with a new track ID, durations,
+// edit list and sample tables.
+func (m *mp4Muxer) trak(t *muxTrack, stbl []byte, duration, mediaDuration uint64) ([]byte, error) {
+	var parts [][]byte
+	for _, c := range t.trak.Children {
+		switch c.Type {
+		case "tkhd":
+			p := slices.Clone(c.Payload)
+			if err := putHeaderField(p, 12, 20, 4, uint64(t.id)); err != nil {
+				return nil, fmt.Errorf("tkhd: %v", err)
+			}
+			if err := putHeaderField(p, 20, 28, 8, duration); err != nil {
+				return nil, fmt.Errorf("tkhd: %v", err)
+			}
+			parts = append(parts, bmff.Encode("tkhd", p))
+			if edits := m.edits(t); len(edits) > 0 {
+				parts = append(parts, bmff.Encode("edts", elstBox(edits)))
+			}
+		case "edts":
+			// Written after tkhd, where it belongs.
+		case "mdia":
+			mdia, err := t.mdia(c, stbl, mediaDuration)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, mdia)
+		case "tref":
+			// Track references name the track IDs of the input file.
+		default:
+			parts = append(parts, bmff.Encode(c.Type, c.Payload))
+		}
+	}
+	return bmff.Encode("trak", parts...), nil
+}
+
+func (t *muxTrack) mdia(mdia bmff.Box, stbl []byte, duration uint64) ([]byte, error) {
+	var parts [][]byte
+	for _, c := range mdia.Children {
+		switch c.Type {
+		case "mdhd":
+			p := slices.Clone(c.Payload)
+			if err := putHeaderField(p, 16, 24, 8, duration); err != nil {
+				return nil, fmt.Errorf("mdhd: %v", err)
+			}
+			parts = append(parts, bmff.Encode("mdhd", p))
+		case "minf":
+			var minf [][]byte
+			for _, b := range c.Children {
+				if b.Type != "stbl" {
+					minf = append(minf, bmff.Encode(b.Type, b.Payload))
+					continue
+				}
+				// Sample entries point at a data reference, which means
+				// "this file" when it is self-contained.
+				if _, ok := c.Find("dinf"); !ok {
+					url := bmff.EncodeFull("url ", 0, 1)
+					minf = append(minf, bmff.Encode("dinf", bmff.EncodeFull("dref", 0, 0, binary.BigEndian.AppendUint32(nil, 1), url)))
+				}
+				minf = append(minf, stbl)
+			}
+			parts = append(parts, bmff.Encode("minf", minf...))
+		default:
+			parts = append(parts, bmff.Encode(c.Type, c.Payload))
+		}
+	}
+	return bmff.Encode("mdia", parts...), nil
+}
+
+// stsd returns the sample description box of a track, with its codec
+// configuration (avcC, hvcC, esds, dOps and so on) untouched.
+func (t *muxTrack) stsd() ([]byte, error) {
+	stsd, ok := t.trak.Find("mdia", "minf", "stbl", "stsd")
+	if !ok {
+		return nil, fmt.Errorf("track %d has no stsd box", t.mp4Track.id)
+	}
+	return bmff.Encode("stsd", stsd.Payload), nil
+}
+
+// putHeaderField sets a field of a tkhd, mdhd or mvhd payload. off0 and off1
+// are its offsets in version 0 and version 1 boxes; size1 is its size in
+// version 1, version 0 fields are always 4 bytes.
+func putHeaderField(p []byte, off0, off1, size1 int, v uint64) error {
+	if len(p) > 0 && p[0] == 1 {
+		if len(p) < off1+size1 {
+			return fmt.Errorf("truncated header")
+		}
+		if size1 == 8 {
+			binary.BigEndian.PutUint64(p[off1:], v)
+		} else {
+			binary.BigEndian.PutUint32(p[off1:], uint32(v))
+		}
+		return nil
+	}
+	if len(p) < off0+4 {
+		return fmt.Errorf("truncated header")
+	}
+	if v > math.MaxUint32 {
+		return fmt.Errorf("%d does not fit in a version 0 header", v)
+	}
+	binary.BigEndian.PutUint32(p[off0:], uint32(v))
+	return nil
+}
+
+func elstBox(edits []mp4Edit) []byte {
+	version := byte(0)
+	for _, e := range edits {
+		if e.duration > math.MaxUint32 || e.mediaTime > math.MaxInt32 || e.mediaTime < math.MinInt32 {
+			version = 1
+		}
+	}
+	b := binary.BigEndian.AppendUint32(nil, uint32(len(edits)))
+	for _, e := range edits {
+		if version == 1 {
+			b = binary.BigEndian.AppendUint64(b, e.duration)
+			b = binary.BigEndian.AppendUint64(b, uint64(e.mediaTime))
+		} else {
+			b = binary.BigEndian.AppendUint32(b, uint32(e.duration))
+			b = binary.BigEndian.AppendUint32(b, uint32(e.mediaTime))
+		}
+		b = binary.BigEndian.AppendUint32(b, e.rate)
+	}
+	return bmff.EncodeFull("elst", version, 0, b)
+}
+
+func mvhdBox(timescale uint32, duration uint64, nextTrackID uint32) []byte {
+	var b []byte
+	version := byte(0)
+	if duration > math.MaxUint32 {
+		version = 1
+		b = make([]byte, 16)
+		b = binary.BigEndian.AppendUint32(b, timescale)
+		b = binary.BigEndian.AppendUint64(b, duration)
+	} else {
+		b = make([]byte, 8)
+		b = binary.BigEndian.AppendUint32(b, timescale)
+		b = binary.BigEndian.AppendUint32(b, uint32(duration))
+	}
+	b = binary.BigEndian.AppendUint32(b, 0x00010000) // rate 1.0
+	b = binary.BigEndian.AppendUint16(b, 0x0100)     // volume 1.0
+	b = append(b, make([]byte, 10)...)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	b = append(b, make([]byte, 24)...)
+	b = binary.BigEndian.AppendUint32(b, nextTrackID)
+	return bmff.EncodeFull("mvhd", version, 0, b)
+}
+
+func ftypBox(compatible ...string) []byte {
+	ftyp := &bmff.Ftyp{MajorBrand: "isom", MinorVersion: 0x200, CompatibleBrands: compatible}
+	return ftyp.Encode()
+}
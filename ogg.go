@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	oggContinued = 0x01
+	oggBOS       = 0x02
+	oggEOS       = 0x04
+
+	// oggPageTarget is the body size after which the next packet starts a
+	// new page.
+	oggPageTarget = 4096
+)
+
+var oggCRCTable = func() [256]uint32 {
+	var t [256]uint32
+	for i := range t {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		t[i] = r
+	}
+	return t
+}()
+
+func oggCRC(b []byte) uint32 {
+	var crc uint32
+	for _, c := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^c]
+	}
+	return crc
+}
+
+// oggWriter packs packets of one logical bitstream into Ogg pages.
+type oggWriter struct {
+	w      io.Writer
+	serial uint32
+	seq    uint32
+
+	segments []byte
+	body     []byte
+	// granule of the last packet that ended on the current page, or -1
+	granule   int64
+	continued bool
+	started   bool
+}
+
+func newOggWriter(w io.Writer, serial uint32) *oggWriter {
+	return &oggWriter{w: w, serial: serial, granule: -1}
+}
+
+// writePacket adds a packet whose end is at granule. Pages are closed as they
+// fill up; a packet that does not fit continues on the next page. The last
+// packet always stays pending so that close can mark its page.
+func (o *oggWriter) writePacket(packet []byte, granule int64) error {
+	if len(o.body) >= oggPageTarget {
+		if err := o.flush(); err != nil {
+			return err
+		}
+	}
+
+	for first := true; ; first = false {
+		if len(o.segments) == 255 {
+			if err := o.writePage(false); err != nil {
+				return err
+			}
+			// The new page only continues the packet if part of it went
+			// onto the page just written.
+			o.continued = !first
+		}
+		n := min(len(packet), 255)
+		o.segments = append(o.segments, byte(n))
+		o.body = append(o.body, packet[:n]...)
+		packet = packet[n:]
+		if n < 255 {
+			break
+		}
+	}
+	o.granule = granule
+	return nil
+}
+
+// flush closes the current page so that the next packet starts a new one.
+func (o *oggWriter) flush() error {
+	if len(o.segments) == 0 {
+		return nil
+	}
+	return o.writePage(false)
+}
+
+// close writes the last page with the end-of-stream flag.
+func (o *oggWriter) close() error {
+	return o.writePage(true)
+}
+
+func (o *oggWriter) writePage(eos bool) error {
+	var flags byte
+	if !o.started {
+		flags |= oggBOS
+	}
+	if o.continued {
+		flags |= oggContinued
+	}
+	if eos {
+		flags |= oggEOS
+	}
+
+	page := make([]byte, 27, 27+len(o.segments)+len(o.body))
+	copy(page, "OggS")
+	page[5] = flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(o.granule))
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.seq)
+	page[26] = byte(len(o.segments))
+	page = append(page, o.segments...)
+	page = append(page, o.body...)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+
+	if _, err := o.w.Write(page); err != nil {
+		return err
+	}
+
+	// A page on which no packet ends carries a granule position of -1.
+	o.seq++
+	o.started = true
+	o.continued = false
+	o.granule = -1
+	o.segments = o.segments[:0]
+	o.body = o.body[:0]
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// oggTestPage is the header of an Ogg page and its lacing values.
+type oggTestPage struct {
+	flags    byte
+	granule  int64
+	segments []byte
+}
+
+func readOggTestPages(t *testing.T, b []byte) []oggTestPage {
+	t.Helper()
+	var pages []oggTestPage
+	for len(b) > 0 {
+		if len(b) < 27 || string(b[:4]) != "OggS" {
+			t.Fatalf("no page at %d bytes from the end", len(b))
+		}
+		n := int(b[26])
+		segments := b[27 : 27+n]
+		size := 0
+		for _, s := range segments {
+			size += int(s)
+		}
+		var granule int64
+		for i := 7; i >= 0; i-- {
+			granule = granule<<8 | int64(b[6+i])
+		}
+		pages = append(pages, oggTestPage{flags: b[5], granule: granule, segments: segments})
+		b = b[27+n+size:]
+	}
+	return pages
+}
+
+func TestOggWriterPacketAfterFullPage(t *testing.T) {
+	var buf bytes.Buffer
+	o := newOggWriter(&buf, 1)
+	for i := 0; i < 255; i++ {
+		if err := o.writePacket([]byte{byte(i)}, int64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.writePacket(make([]byte, 300), 255); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readOggTestPages(t, buf.Bytes())
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	if len(pages[0].segments) != 255 || pages[0].granule != 254 {
+		t.Errorf("first page has %d segments and granule %d, want 255 and 254", len(pages[0].segments), pages[0].granule)
+	}
+	if pages[1].flags&oggContinued != 0 {
+		t.Errorf("page starting a new packet has the continued flag")
+	}
+	if !bytes.Equal(pages[1].segments, []byte{255, 45}) {
+		t.Errorf("second page has lacing %v, want [255 45]", pages[1].segments)
+	}
+}
+
+func TestOggWriterContinuedPacket(t *testing.T) {
+	var buf bytes.Buffer
+	o := newOggWriter(&buf, 1)
+	if err := o.writePacket(make([]byte, 255*256), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := readOggTestPages(t, buf.Bytes())
+	if len(pages) != 2 {
+		t.Fatalf("got %d pages, want 2", len(pages))
+	}
+	if pages[0].granule != -1 {
+		t.Errorf("page on which no packet ends has granule %d", pages[0].granule)
+	}
+	if pages[1].flags&oggContinued == 0 {
+		t.Errorf("page continuing a packet lacks the continued flag")
+	}
+}
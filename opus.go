@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+
+	"blurlconvert/bmff"
+)
+
+// opusGranuleRate is the rate of Ogg Opus granule positions, whatever the
+// input sampling rate was.
+const opusGranuleRate = 48000
+
+// opusConfig is the Opus decoder configuration carried by the dOps box in MP4
+// and by the OpusHead packet in Ogg.
+type opusConfig struct {
+	channels   uint8
+	preSkip    uint16
+	sampleRate uint32
+	gain       int16
+	family     uint8
+	streams    uint8
+	coupled    uint8
+	mapping    []byte
+}
+
+// parseDOps reads an OpusSpecificBox payload, whose fields are big endian.
+func parseDOps(p []byte) (opusConfig, error) {
+	if len(p) < 11 {
+		return opusConfig{}, fmt.Errorf("truncated dOps")
+	}
+	if p[0] != 0 {
+		return opusConfig{}, fmt.Errorf("unsupported dOps version %d", p[0])
+	}
+
+	c := opusConfig{
+		channels:   p[1],
+		preSkip:    binary.BigEndian.Uint16(p[2:4]),
+		sampleRate: binary.BigEndian.Uint32(p[4:8]),
+		gain:       int16(binary.BigEndian.Uint16(p[8:10])),
+		family:     p[10],
+	}
+	if c.channels == 0 {
+		return opusConfig{}, fmt.Errorf("dOps has no channels")
+	}
+
+	if c.family == 0 {
+		if c.channels > 2 {
+			return opusConfig{}, fmt.Errorf("mapping family 0 with %d channels", c.channels)
+		}
+		return c, nil
+	}
+
+	if len(p) < 13+int(c.channels) {
+		return opusConfig{}, fmt.Errorf("truncated dOps channel mapping")
+	}
+	c.streams = p[11]
+	c.coupled = p[12]
+	c.mapping = append([]byte(nil), p[13:13+int(c.channels)]...)
+	return c, nil
+}
+
+// head is the OpusHead identification packet (RFC 7845, section 5.1), whose
+// fields are little endian.
+func (c opusConfig) head() []byte {
+	b := make([]byte, 19, 21+len(c.mapping))
+	copy(b, "OpusHead")
+	b[8] = 1
+	b[9] = c.channels
+	binary.LittleEndian.PutUint16(b[10:], c.preSkip)
+	binary.LittleEndian.PutUint32(b[12:], c.sampleRate)
+	binary.LittleEndian.PutUint16(b[16:], uint16(c.gain))
+	b[18] = c.family
+	if c.family != 0 {
+		b = append(b, c.streams, c.coupled)
+		b = append(b, c.mapping...)
+	}
+	return b
+}
+
+// opusTags is the comment header packet (RFC 7845, section 5.2).
+func opusTags(tags []tag) []byte {
+	return append([]byte("OpusTags"), vorbisComments(tags)...)
+}
+
+// remuxOpus copies the Opus packets of a decrypted MP4 audio track into an
+// Ogg Opus file without decoding them. A duration above 0 trims the stream to
+// that many seconds.
+func remuxOpus(src, dst string, duration float64, tags []tag) error {
+	buf, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	track, err := readTrack(buf, "Opus")
+	if err != nil {
+		return err
+	}
+
+	entry, err := bmff.ParseSampleEntry(track.entry)
+	if err != nil {
+		return err
+	}
+	dops, ok := bmff.Find(entry.Children, "dOps")
+	if !ok {
+		return fmt.Errorf("Opus sample entry has no dOps box")
+	}
+	config, err := parseDOps(dops.Payload)
+	if err != nil {
+		return err
+	}
+
+	// Where the edit list starts playback is the pre-skip. A clipped track
+	// skips more than dOps says: the preroll and the part of the first packet
+	// before the clip.
+	if track.hasEdit {
+		skip := track.editStart * opusGranuleRate / int64(track.timescale)
+		if skip > int64(config.preSkip) && skip <= math.MaxUint16 {
+			config.preSkip = uint16(skip)
+		}
+	}
+
+	// Sample tables without stts leave durations at 0; the packets know them.
+	for i, s := range track.samples {
+		if s.duration != 0 {
+			continue
+		}
+		packet, err := track.sampleData(buf, i)
+		if err != nil {
+			return err
+		}
+		track.samples[i].duration = uint32(uint64(opusPacketSamples(packet)) * uint64(track.timescale) / opusGranuleRate)
+	}
+
+	// Ogg granule positions include the pre-skip, so the end of the stream is
+	// the pre-skip plus the playable length. MP4 gives that length through its
+	// edit list; without one every decoded sample is kept.
+	var total uint64
+	for _, s := range track.samples {
+		total += uint64(s.duration)
+	}
+	end := int64(total * opusGranuleRate / uint64(track.timescale))
+	if track.hasEdit && track.movieTimescale > 0 {
+		playable := int64(track.editDuration * opusGranuleRate / uint64(track.movieTimescale))
+		if limit := int64(config.preSkip) + playable; playable > 0 && limit < end {
+			end = limit
+		}
+	}
+	if duration > 0 {
+		end = min(end, int64(config.preSkip)+int64(math.Round(duration*opusGranuleRate)))
+	}
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	head := config.head()
+	ogg := newOggWriter(w, crc32.ChecksumIEEE(head))
+
+	if err := ogg.writePacket(head, 0); err != nil {
+		return err
+	}
+	if err := ogg.flush(); err != nil {
+		return err
+	}
+	if err := ogg.writePacket(opusTags(tags), 0); err != nil {
+		return err
+	}
+	if err := ogg.flush(); err != nil {
+		return err
+	}
+
+	var elapsed uint64
+	for i, s := range track.samples {
+		// Packets that start after the end are not needed at all.
+		if i > 0 && int64(elapsed*opusGranuleRate/uint64(track.timescale)) >= end {
+			break
+		}
+		packet, err := track.sampleData(buf, i)
+		if err != nil {
+			return err
+		}
+		elapsed += uint64(s.duration)
+		granule := min(int64(elapsed*opusGranuleRate/uint64(track.timescale)), end)
+		if err := ogg.writePacket(packet, granule); err != nil {
+			return err
+		}
+	}
+
+	if err := ogg.close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// opusPacketSamples is the duration of a packet at 48 kHz, read from its TOC
+// byte (RFC 6716, section 3.1).
+func opusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := int(toc >> 3)
+
+	// Frame sizes in units of 2.5 ms.
+	var frame int
+	switch {
+	case config < 12:
+		frame = []int{4, 8, 16, 24}[config%4]
+	case config < 16:
+		frame = []int{4, 8}[config%2]
+	default:
+		frame = []int{1, 2, 4, 8}[config%4]
+	}
+
+	frames := 1
+	switch toc & 3 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = int(packet[1] & 0x3f)
+	}
+	return frames * frame * 120
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type outputPlan struct {
+	target string
+	suffix string
+
+	// template is the --output-template, relative to the output directory.
+	// Without one, files are named after kind and the track.
+	template       string
+	templateSuffix string
+	kind           string
+	tracks         int
+	fields         nameFields
+}
+
+func (o outputPlan) isDir() bool {
+	if o.target == "" {
+		return false
+	}
+	if strings.HasSuffix(o.target, "/") || strings.HasSuffix(o.target, string(os.PathSeparator)) {
+		return true
+	}
+	return isDirExists(o.target)
+}
+
+func (o outputPlan) dir() string {
+	switch {
+	case o.target == "":
+		return "."
+	case o.isDir():
+		return o.target
+	}
+	return filepath.Dir(o.target)
+}
+
+// path places a file next to the final output without taking the output's name.
+func (o outputPlan) path(name string) string {
+	return filepath.Join(o.dir(), withSuffix(name, o.suffix))
+}
+
+// file is the final output: the target itself unless the target is a directory.
+func (o outputPlan) file(name string) string {
+	if o.target == "" || o.isDir() {
+		return o.path(name)
+	}
+	return withSuffix(o.target, o.suffix)
+}
+
+// track names one of several outputs after the target, e.g. song.mp4 becomes song_audio.mp4.
+func (o outputPlan) track(name string, suffix string) string {
+	if o.target == "" || o.isDir() {
+		return o.path(name)
+	}
+	return withSuffix(withSuffix(o.target, o.suffix), suffix)
+}
+
+// trackFile names the final file of a track, or of one stem of it.
+func (o outputPlan) trackFile(t TrackDownload, stem string) string {
+	if o.template != "" {
+		f := o.fields
+		f.track, f.codec, f.sampleRate, f.stem = t.Name, t.Codec, t.SampleRate, stem
+		if name, ok := o.expand(f); ok {
+			return name
+		}
+	}
+	if stem != "" {
+		// Stems of a track that shares its type with others carry its name.
+		if t.Name != t.MediaType {
+			stem = t.Name + "_" + stem
+		}
+		return o.track(stem+"."+o.fields.ext, stem)
+	}
+	name := fmt.Sprintf("%s_%s.%s", o.kind, t.Name, o.fields.ext)
+	if o.tracks == 1 {
+		return o.file(name)
+	}
+	return o.track(name, t.Name)
+}
+
+// mergedFile names the file the tracks of a playlist are merged into. It has
+// no track or codec of its own; the sampling rate is the audio track's.
+func (o outputPlan) mergedFile(name string, tracks []TrackDownload) string {
+	if o.template != "" {
+		f := o.fields
+		for _, t := range tracks {
+			if t.MediaType == "audio" {
+				f.sampleRate = t.SampleRate
+			}
+		}
+		if name, ok := o.expand(f); ok {
+			return name
+		}
+	}
+	return o.file(name)
+}
+
+// expand places a name made from the template in the output directory. The
+// template was checked when the flags were parsed; ok is only false when the
+// values leave it with no name at all, and the default name is used instead.
+func (o outputPlan) expand(f nameFields) (string, bool) {
+	name, err := expandTemplate(o.template, f)
+	if err != nil {
+		return "", false
+	}
+	return filepath.Join(o.dir(), withSuffix(name, o.templateSuffix)), true
+}
+
+// playlistFields are the name fields shared by every output of a playlist.
+func playlistFields(input string, p Playlist, ext string) nameFields {
+	f := nameFields{
+		input:    inputName(input),
+		assetID:  playlistAssetID(p),
+		language: p.Language,
+		typ:      playlistMain,
+		ext:      ext,
+	}
+	if p.isPreview() {
+		f.typ = playlistPreview
+	}
+	return f
+}
+
+// templateSuffixes are the suffixes added to names from a template when
+// several playlists are converted. A template that already names each
+// playlist's outputs apart needs none; otherwise they get the suffixes the
+// default names carry, rather than overwriting each other.
+func templateSuffixes(tpl, input string, playlists []Playlist, ext string, suffixes []string) []string {
+	seen := make(map[string]bool)
+	for _, p := range playlists {
+		f := nameFields{}.placeholders()
+		pf := playlistFields(input, p, ext)
+		f.input, f.assetID, f.language, f.typ, f.ext = pf.input, pf.assetID, pf.language, pf.typ, pf.ext
+		name, err := expandTemplate(tpl, f)
+		if err != nil || seen[name] {
+			return suffixes
+		}
+		seen[name] = true
+	}
+	return make([]string, len(playlists))
+}
+
+// nameFields are the values an --output-template can use.
+type nameFields struct {
+	input      string
+	assetID    string
+	language   string
+	typ        string
+	kid        string
+	track      string
+	codec      string
+	sampleRate int
+	stem       string
+	ext        string
+}
+
+func (f nameFields) lookup(name string) (string, bool) {
+	switch name {
+	case "input":
+		return f.input, true
+	case "assetId":
+		return f.assetID, true
+	case "language":
+		return f.language, true
+	case "type":
+		return f.typ, true
+	case "kid":
+		return f.kid, true
+	case "track":
+		return f.track, true
+	case "codec":
+		return f.codec, true
+	case "sampleRate":
+		if f.sampleRate == 0 {
+			return "", true
+		}
+		return strconv.Itoa(f.sampleRate), true
+	case "stem":
+		return f.stem, true
+	case "ext":
+		return f.ext, true
+	}
+	return "", false
+}
+
+// placeholders fills every field with its name, to check a template before
+// any value is known.
+func (f nameFields) placeholders() nameFields {
+	return nameFields{
+		input: "input", assetID: "assetId", language: "language", typ: "type", kid: "kid",
+		track: "track", codec: "codec", sampleRate: 48000, stem: "stem", ext: f.ext,
+	}
+}
+
+// expandTemplate fills in a template such as
+// "{assetId}/{language}_{type}_{stem}.{ext}". Slashes in the template make
+// directories; values are sanitised so they cannot. An empty value also drops
+// a separator next to it, so "{type}_{stem}" gives "main" without a stem.
+func expandTemplate(tpl string, f nameFields) (string, error) {
+	isSep := func(c byte) bool { return c == '_' || c == '-' || c == ' ' }
+
+	var out string
+	// dropSep is set after an empty value that starts a name, whose separator
+	// follows it instead.
+	dropSep := false
+	for rest := tpl; rest != ""; {
+		if dropSep && isSep(rest[0]) {
+			rest = rest[1:]
+		}
+		dropSep = false
+
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			out += rest
+			break
+		}
+		out += rest[:open]
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed { in %q", tpl)
+		}
+		field := rest[open+1 : open+end]
+		value, ok := f.lookup(field)
+		if !ok {
+			return "", fmt.Errorf("unknown field {%s}", field)
+		}
+		value = sanitizeName(value)
+		if value == "" {
+			switch {
+			case out == "" || out[len(out)-1] == '/':
+				dropSep = true
+			case isSep(out[len(out)-1]):
+				out = out[:len(out)-1]
+			}
+		}
+		out += value
+		rest = rest[open+end+1:]
+	}
+
+	var parts []string
+	for _, part := range strings.Split(filepath.ToSlash(out), "/") {
+		if part = strings.TrimSpace(part); part != "" && part != "." {
+			parts = append(parts, part)
+		}
+	}
+	name := path.Join(parts...)
+	if name == "" || name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("%q gives the name %q, which is outside the output directory", tpl, out)
+	}
+	return filepath.FromSlash(name), nil
+}
+
+// sanitizeName replaces the characters that are not allowed in file names on
+// some system, and the dots and spaces Windows drops from the end of a name.
+func sanitizeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.Trim(s, ". ")
+}
+
+// checkOutputs refuses outputs that would be written to the same file, and
+// files that already exist unless force is set.
+func checkOutputs(paths []string, force bool) error {
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		if seen[p] {
+			return withExit(exitUsage, fmt.Errorf("several outputs would be written to %s, add {track} or {stem} to --output-template", p))
+		}
+		seen[p] = true
+		if !force && fileExists(p) {
+			return withExit(exitUsage, fmt.Errorf("%s already exists, use --force to overwrite it", p))
+		}
+	}
+	return nil
+}
+
+// inputName is the base name of an input file without its extension.
+func inputName(input string) string {
+	base := filepath.Base(input)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// playlistAssetID reads the asset ID of a playlist from its data, when that
+// holds the playlist metadata, and otherwise takes the directory of its URL,
+// which is named after the asset.
+func playlistAssetID(p Playlist) string {
+	var meta PlaylistMetadata
+	if err := json.Unmarshal([]byte(p.Data), &meta); err == nil && meta.Metadata.AssetID != "" {
+		return meta.Metadata.AssetID
+	}
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return ""
+	}
+	dir := path.Base(path.Dir(u.Path))
+	if dir == "/" || dir == "." {
+		return ""
+	}
+	return dir
+}
+
+func withSuffix(name, suffix string) string {
+	if suffix == "" {
+		return name
+	}
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "_" + suffix + ext
+}
+
+// publish moves a finished file from the workspace to dst. When the two are on
+// different filesystems the file is copied next to dst first and renamed into
+// place, so dst never holds a partial file.
+func publish(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// masterName names the merged file of a full song after the start of its
+// KID, which tells songs apart when several are written to one directory.
+// Manifests without a usable default_KID give plain "master.mp4".
+func masterName(mpd *MPD) string {
+	kids := defaultKIDs(mpd)
+	if len(kids) == 0 {
+		return "master.mp4"
+	}
+	return kids[0].String()[:8] + "_master.mp4"
+}
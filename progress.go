@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	stageManifest = "manifest"
+	stageDownload = "download"
+	stageSegment  = "segment"
+	stageDecrypt  = "decrypt"
+	stageMerge    = "merge"
+	stageExport   = "export"
+)
+
+const (
+	eventStart    = "start"
+	eventProgress = "progress"
+	eventDone     = "done"
+	eventError    = "error"
+)
+
+// ProgressEvent describes one step of a conversion. Download progress events
+// carry the bytes received since the previous event for the same track.
+// Segment events count from 1 to Total over the segments being downloaded,
+// which with a clip are not all of the track's.
+type ProgressEvent struct {
+	Time    time.Time `json:"time"`
+	Job     string    `json:"job,omitempty"`
+	Stage   string    `json:"stage"`
+	Status  string    `json:"status"`
+	Track   string    `json:"track,omitempty"`
+	Segment int       `json:"segment,omitempty"`
+	Total   int       `json:"total,omitempty"`
+	Bytes   int64     `json:"bytes,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type ProgressReporter interface {
+	Report(ev ProgressEvent)
+}
+
+var progress ProgressReporter = nopProgress{}
+
+func reportProgress(ev ProgressEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	progress.Report(ev)
+	recordEvent(ev)
+}
+
+// trackRef names the job and track that progress events and log lines belong to.
+type trackRef struct {
+	Job   string
+	Track string
+}
+
+func (r trackRef) report(ev ProgressEvent) {
+	ev.Job = r.Job
+	ev.Track = r.Track
+	reportProgress(ev)
+}
+
+func (r trackRef) reportError(stage string, err error) {
+	r.report(ProgressEvent{Stage: stage, Status: eventError, Error: err.Error()})
+}
+
+func (r trackRef) logger() *slog.Logger {
+	log := slog.Default()
+	if r.Job != "" {
+		log = log.With("job", r.Job)
+	}
+	if r.Track != "" {
+		log = log.With("track", r.Track)
+	}
+	return log
+}
+
+func newProgressReporter(mode string, w *os.File) (ProgressReporter, error) {
+	switch mode {
+	case "", "auto":
+		if isTerminal(w) {
+			return newTerminalProgress(w), nil
+		}
+		return nopProgress{}, nil
+	case "bar":
+		return newTerminalProgress(w), nil
+	case "json":
+		return &jsonProgress{enc: json.NewEncoder(w)}, nil
+	case "none":
+		return nopProgress{}, nil
+	}
+	return nil, fmt.Errorf("unknown progress mode %q (want auto, bar, json or none)", mode)
+}
+
+type nopProgress struct{}
+
+func (nopProgress) Report(ProgressEvent) {}
+
+type jsonProgress struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (p *jsonProgress) Report(ev ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(ev)
+}
+
+type trackProgress struct {
+	name     string
+	stage    string
+	status   string
+	done     int
+	total    int
+	bytes    int64
+	started  time.Time
+	finished time.Time
+}
+
+type terminalProgress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	tracks   []*trackProgress
+	width    int
+	drawn    int
+	lastDraw time.Time
+}
+
+func newTerminalProgress(w io.Writer) *terminalProgress {
+	return &terminalProgress{w: w}
+}
+
+func (p *terminalProgress) track(name string) *trackProgress {
+	for _, t := range p.tracks {
+		if t.name == name {
+			return t
+		}
+	}
+	t := &trackProgress{name: name, started: time.Now()}
+	p.tracks = append(p.tracks, t)
+	if len(name) > p.width {
+		p.width = len(name)
+	}
+	return t
+}
+
+func (p *terminalProgress) Report(ev ProgressEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	name := ev.Track
+	if name == "" {
+		name = ev.Stage
+	}
+	if ev.Job != "" {
+		name = ev.Job + " " + name
+	}
+	t := p.track(name)
+
+	switch ev.Stage {
+	case stageDownload:
+		t.bytes += ev.Bytes
+		if ev.Status == eventStart && ev.Total > 0 {
+			t.total = ev.Total
+		}
+	case stageSegment:
+		if ev.Status == eventDone {
+			t.done++
+		}
+		if ev.Total > 0 {
+			t.total = ev.Total
+		}
+	}
+
+	if ev.Stage != stageDownload || ev.Status != eventProgress {
+		t.stage = ev.Stage
+		t.status = ev.Status
+	}
+	if ev.Status == eventDone && (ev.Stage == stageMerge || ev.Stage == stageDecrypt || ev.Stage == stageExport || ev.Stage == stageManifest) {
+		t.finished = time.Now()
+	}
+
+	force := ev.Status != eventProgress
+	if !force && time.Since(p.lastDraw) < 100*time.Millisecond {
+		return
+	}
+	p.draw()
+}
+
+// Write prints log output above the bar. The bar is cleared, the output
+// written and the bar drawn again below it, under the lock that drawing takes.
+func (p *terminalProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.drawn > 0 {
+		fmt.Fprintf(p.w, "\x1b[%dA\x1b[J", p.drawn)
+		p.drawn = 0
+	}
+	n, err := p.w.Write(b)
+	if len(p.tracks) > 0 {
+		p.draw()
+	}
+	return n, err
+}
+
+func (p *terminalProgress) draw() {
+	var b strings.Builder
+
+	if p.drawn > 0 {
+		fmt.Fprintf(&b, "\x1b[%dA", p.drawn)
+	}
+	for _, t := range p.tracks {
+		b.WriteString("\x1b[2K")
+		b.WriteString(t.line(p.width))
+		b.WriteByte('\n')
+	}
+
+	io.WriteString(p.w, b.String())
+	p.drawn = len(p.tracks)
+	p.lastDraw = time.Now()
+}
+
+func (t *trackProgress) line(nameWidth int) string {
+	end := time.Now()
+	if !t.finished.IsZero() {
+		end = t.finished
+	}
+	elapsed := end.Sub(t.started)
+
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(t.bytes) / elapsed.Seconds()
+	}
+
+	label := fmt.Sprintf("%-*s %-9s", max(nameWidth, 8), t.name, t.stage)
+	if t.status == eventError {
+		return label + " failed"
+	}
+	if t.total <= 0 {
+		return fmt.Sprintf("%s %9s  %s/s", label, formatBytes(t.bytes), formatBytes(int64(rate)))
+	}
+
+	const width = 30
+	filled := width * t.done / t.total
+	if filled > width {
+		filled = width
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", width-filled)
+
+	eta := "--:--"
+	if t.done > 0 && t.done < t.total {
+		remaining := time.Duration(float64(elapsed) / float64(t.done) * float64(t.total-t.done))
+		eta = formatClock(remaining)
+	} else if t.done >= t.total {
+		eta = formatClock(0)
+	}
+
+	return fmt.Sprintf("%s [%s] %d/%d %9s  %s/s  ETA %s", label, bar, t.done, t.total, formatBytes(t.bytes), formatBytes(int64(rate)), eta)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatClock(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+type progressReader struct {
+	r       io.Reader
+	ref     trackRef
+	pending int64
+	last    time.Time
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.pending += int64(n)
+	if pr.pending > 0 && (err != nil || time.Since(pr.last) >= 100*time.Millisecond) {
+		pr.ref.report(ProgressEvent{Stage: stageDownload, Status: eventProgress, Bytes: pr.pending})
+		pr.pending = 0
+		pr.last = time.Now()
+	}
+	return n, err
+}
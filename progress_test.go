@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTerminalProgressPrintsLogsAboveTheBar(t *testing.T) {
+	var buf bytes.Buffer
+	p := newTerminalProgress(&buf)
+
+	// Nothing drawn yet, so the line is written as it is.
+	p.Write([]byte("first\n"))
+	if buf.String() != "first\n" {
+		t.Fatalf("got %q", buf.String())
+	}
+
+	p.Report(ProgressEvent{Job: "song", Track: "audio", Stage: stageDownload, Status: eventStart, Total: 4})
+	p.Report(ProgressEvent{Job: "song", Track: "video", Stage: stageDownload, Status: eventStart, Total: 4})
+	buf.Reset()
+
+	p.Write([]byte("second\n"))
+	out := buf.String()
+	// The two bar lines are cleared, the log line takes their place and the
+	// bar is drawn again below it.
+	if !strings.HasPrefix(out, "\x1b[2A\x1b[Jsecond\n\x1b[2K") {
+		t.Errorf("log line is not written over the cleared bar: %q", out)
+	}
+	if strings.Count(out, "\x1b[2K") != 2 || strings.Count(out, "\n") != 3 {
+		t.Errorf("bar is not redrawn below the log line: %q", out)
+	}
+	if p.drawn != 2 {
+		t.Errorf("%d lines drawn, want 2", p.drawn)
+	}
+}
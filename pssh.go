@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"blurlconvert/bmff"
+)
+
+// PSSH is what a protection system specific header says about a track: which
+// DRM system it is for and which KIDs that system needs keys for.
+type PSSH struct {
+	// Source is where the header was found: "manifest" or "init".
+	Source   string `json:"source"`
+	SystemID string `json:"systemId"`
+	System   string `json:"system,omitempty"`
+	KIDs     []KID  `json:"kids,omitempty"`
+	// Box is the whole pssh box, for providers that pass it on to a license
+	// server. PlayReady headers given as mspr:pro in the manifest have none.
+	Box []byte `json:"-"`
+}
+
+// drmSystems names the DRM systems by system ID.
+var drmSystems = map[string]string{
+	"edef8ba9-79d6-4ace-a3c8-27dcd51d21ed": "Widevine",
+	"9a04f079-9840-4286-ab92-e65be0885f95": "PlayReady",
+	"1077efec-c0b2-4d02-ace3-3c1e52e2fb4b": "ClearKey",
+	"e2719d58-a985-b3c9-781a-b030af78d30e": "ClearKey",
+	"94ce86fb-07ff-4f43-adb8-93d2fa968ca2": "FairPlay",
+}
+
+const playReadySystemID = "9a04f079-9840-4286-ab92-e65be0885f95"
+
+// formatUUID writes 16 bytes in the 8-4-4-4-12 form used for system IDs and
+// for default_KID in manifests.
+func formatUUID(b [16]byte) string {
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// parsePSSH decodes a pssh box. KIDs come from the box itself in version 1
+// boxes and from the system's data otherwise.
+func parsePSSH(source string, box []byte) (PSSH, error) {
+	boxes, err := bmff.Parse(box)
+	if err != nil {
+		return PSSH{}, err
+	}
+	if len(boxes) != 1 || boxes[0].Type != "pssh" {
+		return PSSH{}, fmt.Errorf("not a pssh box")
+	}
+	p, err := bmff.ParsePssh(boxes[0])
+	if err != nil {
+		return PSSH{}, err
+	}
+	return newPSSH(source, p), nil
+}
+
+func newPSSH(source string, p *bmff.Pssh) PSSH {
+	pssh := PSSH{Source: source, SystemID: formatUUID(p.SystemID), Box: p.Encode()}
+	pssh.System = drmSystems[pssh.SystemID]
+
+	var kids [][16]byte
+	switch {
+	case len(p.KIDs) > 0:
+		kids = p.KIDs
+	case pssh.System == "Widevine":
+		kids = widevineKIDs(p.Data)
+	case pssh.System == "PlayReady":
+		kids = playReadyKIDs(p.Data)
+	}
+	for _, kid := range kids {
+		pssh.KIDs = appendKID(pssh.KIDs, KID(kid))
+	}
+	return pssh
+}
+
+// manifestPSSH collects the protection headers of the ContentProtection
+// elements of an adaptation set: cenc:pssh boxes and PlayReady mspr:pro
+// objects, both base64 encoded.
+func manifestPSSH(protections []contentProtection) []PSSH {
+	var out []PSSH
+	for _, cp := range protections {
+		for _, text := range cp.Pssh {
+			box, err := base64.StdEncoding.DecodeString(strings.TrimSpace(text))
+			if err != nil {
+				continue
+			}
+			if p, err := parsePSSH("manifest", box); err == nil {
+				out = append(out, p)
+			}
+		}
+		if text := strings.TrimSpace(cp.Pro); text != "" {
+			pro, err := base64.StdEncoding.DecodeString(text)
+			if err != nil {
+				continue
+			}
+			p := PSSH{Source: "manifest", SystemID: playReadySystemID, System: "PlayReady"}
+			for _, kid := range playReadyKIDs(pro) {
+				p.KIDs = appendKID(p.KIDs, KID(kid))
+			}
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// initPSSH reads the pssh boxes in the moov of an init segment.
+func initPSSH(buf []byte) ([]PSSH, error) {
+	boxes, err := bmff.Parse(buf)
+	if err != nil {
+		return nil, err
+	}
+	var out []PSSH
+	for _, b := range bmff.FindAll(boxes, "moov", "pssh") {
+		p, err := bmff.ParsePssh(b)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, newPSSH("init", p))
+	}
+	return out, nil
+}
+
+// widevineKIDs reads the key_id fields (field 2) of a WidevinePsshData
+// protobuf message.
+func widevineKIDs(data []byte) [][16]byte {
+	var kids [][16]byte
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			break
+		}
+		data = data[n:]
+
+		var value []byte
+		switch tag & 7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			if n <= 0 {
+				return kids
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return kids
+			}
+			data = data[8:]
+		case 2:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < size {
+				return kids
+			}
+			value = data[n : n+int(size)]
+			data = data[n+int(size):]
+		case 5:
+			if len(data) < 4 {
+				return kids
+			}
+			data = data[4:]
+		default:
+			return kids
+		}
+
+		if tag>>3 == 2 && len(value) == 16 {
+			kids = append(kids, [16]byte(value))
+		}
+	}
+	return kids
+}
+
+// WRM headers up to version 4.0 give a KID as the text of a KID element, later
+// versions in its VALUE attribute.
+var (
+	playReadyKIDElement = regexp.MustCompile(`<KID\b([^>]*)>([^<]*)`)
+	playReadyKIDValue   = regexp.MustCompile(`VALUE="([^"]*)"`)
+)
+
+// playReadyKIDs reads the KIDs of the WRM headers in a PlayReady object. The
+// header is UTF-16 XML and its KIDs are base64 GUIDs, whose first three
+// fields are little endian.
+func playReadyKIDs(pro []byte) [][16]byte {
+	if len(pro) < 6 {
+		return nil
+	}
+	count := int(binary.LittleEndian.Uint16(pro[4:6]))
+	records := pro[6:]
+
+	var kids [][16]byte
+	for i := 0; i < count && len(records) >= 4; i++ {
+		typ := binary.LittleEndian.Uint16(records[0:2])
+		size := int(binary.LittleEndian.Uint16(records[2:4]))
+		if len(records) < 4+size {
+			break
+		}
+		record := records[4 : 4+size]
+		records = records[4+size:]
+		if typ != 1 {
+			continue
+		}
+
+		units := make([]uint16, len(record)/2)
+		for j := range units {
+			units[j] = binary.LittleEndian.Uint16(record[2*j:])
+		}
+		header := string(utf16.Decode(units))
+		for _, m := range playReadyKIDElement.FindAllStringSubmatch(header, -1) {
+			value := m[2]
+			if v := playReadyKIDValue.FindStringSubmatch(m[1]); v != nil {
+				value = v[1]
+			}
+			guid, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+			if err != nil || len(guid) != 16 {
+				continue
+			}
+			var kid [16]byte
+			kid[0], kid[1], kid[2], kid[3] = guid[3], guid[2], guid[1], guid[0]
+			kid[4], kid[5] = guid[5], guid[4]
+			kid[6], kid[7] = guid[7], guid[6]
+			copy(kid[8:], guid[8:])
+			kids = append(kids, kid)
+		}
+	}
+	return kids
+}
+
+// uniquePSSH drops headers that repeat an earlier one, as the init segments of
+// several tracks often do.
+func uniquePSSH(list []PSSH) []PSSH {
+	var out []PSSH
+	for _, p := range list {
+		dup := false
+		for _, q := range out {
+			if p.SystemID == q.SystemID && slices.Equal(p.KIDs, q.KIDs) && bytes.Equal(p.Box, q.Box) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func (p PSSH) describe() string {
+	if p.System == "" {
+		return p.SystemID
+	}
+	return fmt.Sprintf("%s (%s)", p.System, p.SystemID)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// conversionReport is the .report.json written next to each output of a
+// playlist: where the output came from, how it was made and what it holds.
+type conversionReport struct {
+	Input       reportFile     `json:"input"`
+	Playlist    reportPlaylist `json:"playlist"`
+	ManifestURL string         `json:"manifestUrl"`
+	KIDs        []KID          `json:"kids,omitempty"`
+	// Key is only written with --report-keys.
+	Key      string        `json:"key,omitempty"`
+	Clip     string        `json:"clip,omitempty"`
+	Tracks   []reportTrack `json:"tracks"`
+	Stages   []reportStage `json:"stages"`
+	Warnings []string      `json:"warnings,omitempty"`
+	Outputs  []reportFile  `json:"outputs"`
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type reportPlaylist struct {
+	Language string  `json:"language,omitempty"`
+	Type     string  `json:"type,omitempty"`
+	Duration float64 `json:"duration,omitempty"`
+	URL      string  `json:"url"`
+}
+
+type reportTrack struct {
+	Type             string `json:"type"`
+	RepresentationID string `json:"representationId"`
+	Codec            string `json:"codec,omitempty"`
+	Bandwidth        int64  `json:"bandwidth,omitempty"`
+	SampleRate       int    `json:"sampleRate,omitempty"`
+	Channels         int    `json:"channels,omitempty"`
+	Segments         int    `json:"segments"`
+	Bytes            int64  `json:"bytes"`
+	Error            string `json:"error,omitempty"`
+
+	// name is the track's name in progress events.
+	name string
+}
+
+// reportStage is the time from the first to the last progress event of a
+// stage; segments count as part of the download.
+type reportStage struct {
+	Stage   string    `json:"stage"`
+	Track   string    `json:"track,omitempty"`
+	Start   time.Time `json:"start"`
+	Seconds float64   `json:"seconds"`
+	Error   string    `json:"error,omitempty"`
+
+	end time.Time
+}
+
+type reportFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+func hashFile(path string) (reportFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return reportFile{}, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return reportFile{}, err
+	}
+	return reportFile{Path: path, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// reportSuffix replaces the extension of an output to name its report.
+const reportSuffix = ".report.json"
+
+// isReportName reports whether a file is a report, so that runs over a
+// directory that holds earlier outputs do not take reports for inputs.
+func isReportName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(name), reportSuffix)
+}
+
+// reportPath is the report written next to an output.
+func reportPath(output string) string {
+	return strings.TrimSuffix(output, filepath.Ext(output)) + reportSuffix
+}
+
+// write finishes the report and writes it next to every output, as
+// name.report.json for an output name.ext.
+func (r *conversionReport) write(rec *reportRecorder, outputs []string, err error) error {
+	r.Finished = time.Now()
+	if err != nil {
+		r.Error = err.Error()
+	}
+	r.Stages, r.Warnings = rec.results()
+	for i := range r.Tracks {
+		r.Tracks[i].Segments, r.Tracks[i].Bytes = rec.download(r.Tracks[i].name)
+	}
+
+	r.Outputs = nil
+	for _, out := range outputs {
+		f, err := hashFile(out)
+		if err != nil {
+			return err
+		}
+		r.Outputs = append(r.Outputs, f)
+	}
+
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	for _, out := range outputs {
+		path := reportPath(out)
+		if err := os.WriteFile(path, buf, 0644); err != nil {
+			return fmt.Errorf("error writing %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// durationTolerance is how far a track may be off its expected length before
+// the report warns about it.
+const durationTolerance = 0.5
+
+// checkTrack warns about gaps between the fragments of a downloaded track and
+// about a length that is not the one expected. expected is 0 when unknown.
+func checkTrack(ref trackRef, path string, expected float64) error {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tracks, err := readTracks(buf)
+	if err != nil {
+		return err
+	}
+
+	log := ref.logger()
+	for _, t := range tracks {
+		ts := float64(t.timescale)
+		for _, g := range t.gaps {
+			log.Warn("gap between fragments", "at", formatTimestamp(float64(g.time)/ts), "seconds", float64(g.length)/ts)
+		}
+
+		length := float64(t.mediaDuration()) / ts
+		if t.hasEdit && t.editDuration > 0 && t.movieTimescale > 0 {
+			length = float64(t.editDuration) / float64(t.movieTimescale)
+		}
+		if expected > 0 && math.Abs(length-expected) > durationTolerance {
+			log.Warn("track length does not match the playlist", "length", formatTimestamp(length), "expected", formatTimestamp(expected))
+		}
+	}
+	return nil
+}
+
+// reportRecorder collects the progress events and warnings of one job while
+// a playlist of it is converted.
+type reportRecorder struct {
+	job string
+
+	mu       sync.Mutex
+	stages   []*reportStage
+	segments map[string]int
+	bytes    map[string]int64
+	warnings []string
+}
+
+var recorders = struct {
+	sync.Mutex
+	m map[string]*reportRecorder
+}{m: make(map[string]*reportRecorder)}
+
+func startRecording(job string) *reportRecorder {
+	r := &reportRecorder{job: job, segments: make(map[string]int), bytes: make(map[string]int64)}
+	recorders.Lock()
+	recorders.m[job] = r
+	recorders.Unlock()
+	return r
+}
+
+func (r *reportRecorder) stop() {
+	recorders.Lock()
+	if recorders.m[r.job] == r {
+		delete(recorders.m, r.job)
+	}
+	recorders.Unlock()
+}
+
+func recorderFor(job string) *reportRecorder {
+	recorders.Lock()
+	defer recorders.Unlock()
+	return recorders.m[job]
+}
+
+func recordEvent(ev ProgressEvent) {
+	r := recorderFor(ev.Job)
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stage := ev.Stage
+	if stage == stageSegment {
+		stage = stageDownload
+		if ev.Status == eventDone {
+			r.segments[ev.Track]++
+		}
+	}
+	if stage == stageDownload {
+		r.bytes[ev.Track] += ev.Bytes
+	}
+
+	var s *reportStage
+	for _, v := range r.stages {
+		if v.Stage == stage && v.Track == ev.Track {
+			s = v
+		}
+	}
+	if s == nil {
+		s = &reportStage{Stage: stage, Track: ev.Track, Start: ev.Time}
+		r.stages = append(r.stages, s)
+	}
+	s.end = ev.Time
+	if ev.Status == eventError && ev.Stage == stage {
+		s.Error = ev.Error
+	}
+}
+
+func recordWarning(job, message string) {
+	if r := recorderFor(job); r != nil {
+		r.mu.Lock()
+		r.warnings = append(r.warnings, message)
+		r.mu.Unlock()
+	}
+}
+
+func (r *reportRecorder) results() ([]reportStage, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stages := make([]reportStage, len(r.stages))
+	for i, s := range r.stages {
+		stages[i] = *s
+		stages[i].Seconds = math.Round(s.end.Sub(s.Start).Seconds()*1000) / 1000
+	}
+	return stages, append([]string(nil), r.warnings...)
+}
+
+func (r *reportRecorder) download(track string) (int, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.segments[track], r.bytes[track]
+}
+
+// reportHandler passes log records on and keeps the warnings of the jobs
+// being recorded, for their reports.
+type reportHandler struct {
+	slog.Handler
+	job   string
+	attrs []slog.Attr
+}
+
+func (h reportHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if rec.Level >= slog.LevelWarn {
+		job := h.job
+		var b strings.Builder
+		b.WriteString(rec.Message)
+		add := func(a slog.Attr) bool {
+			if a.Key == "job" {
+				job = a.Value.String()
+			} else {
+				fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+			}
+			return true
+		}
+		for _, a := range h.attrs {
+			add(a)
+		}
+		rec.Attrs(add)
+		recordWarning(job, b.String())
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h reportHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h.Handler = h.Handler.WithAttrs(attrs)
+	for _, a := range attrs {
+		if a.Key == "job" {
+			h.job = a.Value.String()
+		}
+	}
+	h.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...)
+	return h
+}
+
+func (h reportHandler) WithGroup(name string) slog.Handler {
+	h.Handler = h.Handler.WithGroup(name)
+	return h
+}
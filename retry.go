@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: timeout}
+
+type retryPolicy struct {
+	maxAttempts   int
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	maxRetryAfter time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts:   maxRetries,
+	baseDelay:     retryDelay,
+	maxDelay:      30 * time.Second,
+	maxRetryAfter: 2 * time.Minute,
+}
+
+type statusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("bad status: %s", e.Status)
+}
+
+var errIntegrity = errors.New("file integrity check failed")
+
+func checkStatus(resp *http.Response, accepted ...int) error {
+	for _, code := range accepted {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	retryAfter, _ := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	return &statusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: retryAfter,
+	}
+}
+
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	d := t.Sub(now)
+	if d < 0 {
+		d = 0
+	}
+	return d, true
+}
+
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		switch {
+		case se.StatusCode == http.StatusTooManyRequests:
+			return true
+		case se.StatusCode == http.StatusRequestTimeout:
+			return true
+		case se.StatusCode >= 500:
+			return true
+		}
+		return false
+	}
+
+	if errors.Is(err, errIntegrity) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+
+	// Other network errors, such as a host that does not resolve or a
+	// certificate that does not verify, fail the same way again.
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+
+	return false
+}
+
+func (p retryPolicy) delay(attempt int, err error) time.Duration {
+	var se *statusError
+	if errors.As(err, &se) && se.RetryAfter > 0 {
+		if se.RetryAfter > p.maxRetryAfter {
+			return p.maxRetryAfter
+		}
+		return se.RetryAfter
+	}
+
+	d := p.baseDelay << (attempt - 1)
+	if d <= 0 || d > p.maxDelay {
+		d = p.maxDelay
+	}
+
+	// equal jitter: keep half the backoff, randomise the rest
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (p retryPolicy) do(log *slog.Logger, fn func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil {
+			return nil
+		}
+
+		if !isRetryable(err) {
+			return err
+		}
+
+		if attempt >= p.maxAttempts {
+			return fmt.Errorf("failed after %d attempts: %w", attempt, err)
+		}
+
+		d := p.delay(attempt, err)
+		log.Warn("request failed, retrying", "attempt", attempt, "delay", d, "error", err)
+		time.Sleep(d)
+	}
+}
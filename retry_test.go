@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://example.com/song.mpd", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"server error", &statusError{StatusCode: 503, Status: "503 Service Unavailable"}, true},
+		{"too many requests", &statusError{StatusCode: 429, Status: "429 Too Many Requests"}, true},
+		{"not found", &statusError{StatusCode: 404, Status: "404 Not Found"}, false},
+		{"integrity", fmt.Errorf("segment 3: %w", errIntegrity), true},
+		{"unexpected EOF", urlError(io.ErrUnexpectedEOF), true},
+		{"connection reset", urlError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), true},
+		{"connection refused", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), true},
+		{"timeout", urlError(&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}), true},
+		{"unknown host", urlError(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}), false},
+		{"untrusted certificate", urlError(x509.UnknownAuthorityError{}), false},
+		{"invalid certificate", urlError(x509.CertificateInvalidError{Reason: x509.Expired}), false},
+		{"other", errors.New("malformed manifest"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
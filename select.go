@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type playlistSelector struct {
+	language string
+	typ      string
+	index    int
+	all      bool
+	preview  bool
+	noPrompt bool
+}
+
+func (s playlistSelector) matches(p Playlist) bool {
+	if s.language != "" && !languageMatches(s.language, p.Language) {
+		return false
+	}
+	if s.typ != "" && !strings.EqualFold(s.typ, p.Type) {
+		return false
+	}
+	if s.preview && !p.isPreview() {
+		return false
+	}
+	return true
+}
+
+// languageMatches accepts the exact tag or its primary subtag, so "en" matches "en-US".
+func languageMatches(want, have string) bool {
+	if strings.EqualFold(want, have) {
+		return true
+	}
+	primary, _, _ := strings.Cut(have, "-")
+	primary, _, _ = strings.Cut(primary, "_")
+	return strings.EqualFold(want, primary)
+}
+
+func (s playlistSelector) selectPlaylists(blurl *BLURL) ([]Playlist, error) {
+	if len(blurl.Playlists) == 0 {
+		return nil, withExit(exitInput, fmt.Errorf("blurl has no playlists"))
+	}
+
+	if s.index > 0 {
+		if s.index > len(blurl.Playlists) {
+			return nil, withExit(exitUsage, fmt.Errorf("playlist index %d is out of range (1-%d)", s.index, len(blurl.Playlists)))
+		}
+		p := blurl.Playlists[s.index-1]
+		if !s.matches(p) {
+			return nil, withExit(exitUsage, fmt.Errorf("playlist %d (%s) does not match %s", s.index, describePlaylist(p), s))
+		}
+		return []Playlist{p}, nil
+	}
+
+	var matched []Playlist
+	for _, p := range blurl.Playlists {
+		if s.matches(p) {
+			matched = append(matched, p)
+		}
+	}
+
+	// A blurl with both the full song and its preview is converted as the full
+	// song, unless the preview is asked for.
+	if s.typ == "" && !s.preview {
+		if main := mainPlaylists(matched); len(main) > 0 {
+			matched = main
+		}
+	}
+
+	switch {
+	case len(matched) == 0:
+		return nil, withExit(exitUsage, fmt.Errorf("no playlist matches %s; available: %s", s, describePlaylists(blurl.Playlists)))
+	case s.all || len(matched) == 1:
+		return matched, nil
+	}
+
+	if s.noPrompt || !isTerminal(os.Stdin) {
+		return nil, withExit(exitUsage, fmt.Errorf("%d playlists match (%s); choose one with --language, --playlist-type or --index, or use --all-playlists", len(matched), describePlaylists(matched)))
+	}
+
+	mediaurl := GetMediaURL(&BLURL{Playlists: matched})
+	for _, p := range matched {
+		if mediaurl != "" && p.URL == mediaurl {
+			return []Playlist{p}, nil
+		}
+	}
+	return nil, withExit(exitUsage, fmt.Errorf("no valid media URL selected"))
+}
+
+func (s playlistSelector) String() string {
+	var parts []string
+	if s.language != "" {
+		parts = append(parts, "language "+s.language)
+	}
+	if s.typ != "" {
+		parts = append(parts, "type "+s.typ)
+	}
+	if s.preview {
+		parts = append(parts, "previews only")
+	}
+	if len(parts) == 0 {
+		return "the selection"
+	}
+	return strings.Join(parts, " and ")
+}
+
+func mainPlaylists(playlists []Playlist) []Playlist {
+	var main []Playlist
+	for _, p := range playlists {
+		if !p.isPreview() {
+			main = append(main, p)
+		}
+	}
+	return main
+}
+
+func describePlaylist(p Playlist) string {
+	language := p.Language
+	if language == "" {
+		language = "?"
+	}
+	if p.Type == "" {
+		return language
+	}
+	return language + "/" + p.Type
+}
+
+func describePlaylists(playlists []Playlist) string {
+	names := make([]string, len(playlists))
+	for i, p := range playlists {
+		names[i] = describePlaylist(p)
+	}
+	return strings.Join(names, ", ")
+}
+
+// playlistSuffixes names each playlist of an --all-playlists run, by language
+// where that is unique and by language and type otherwise.
+func playlistSuffixes(playlists []Playlist) []string {
+	suffixes := make([]string, len(playlists))
+	count := map[string]int{}
+	for i, p := range playlists {
+		suffixes[i] = sanitizeSuffix(p.Language)
+		if suffixes[i] == "" {
+			suffixes[i] = fmt.Sprintf("playlist%d", i+1)
+		}
+		count[suffixes[i]]++
+	}
+
+	seen := map[string]int{}
+	for i, p := range playlists {
+		if count[suffixes[i]] > 1 && p.Type != "" {
+			suffixes[i] += "_" + sanitizeSuffix(p.Type)
+		}
+		seen[suffixes[i]]++
+		if seen[suffixes[i]] > 1 {
+			suffixes[i] = fmt.Sprintf("%s_%d", suffixes[i], seen[suffixes[i]])
+		}
+	}
+	return suffixes
+}
+
+func sanitizeSuffix(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return -1
+	}, s)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// stem is one instrument of a multitrack master and the channels, counted from
+// 0, that carry it.
+type stem struct {
+	name     string
+	channels []int
+}
+
+// festivalStemMap is how Festival song masters lay out their stems: one
+// channel pair per instrument.
+const festivalStemMap = "drums=1+2,bass=3+4,lead=5+6,vocals=7+8,other=9+10"
+
+// parseStemMap reads a map such as "drums=1+2,bass=3+4,click=11". Channels are
+// counted from 1 and a stem has one or two of them.
+func parseStemMap(s string) ([]stem, error) {
+	var stems []stem
+	seen := map[string]bool{}
+
+	for _, entry := range strings.Split(s, ",") {
+		name, list, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("stem %q has no channels, expected name=channel+channel", entry)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" || sanitizeSuffix(name) != name {
+			return nil, fmt.Errorf("invalid stem name %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("stem %q is listed twice", name)
+		}
+		seen[name] = true
+
+		st := stem{name: name}
+		for _, c := range strings.Split(list, "+") {
+			n, err := strconv.Atoi(strings.TrimSpace(c))
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid channel %q for stem %s", c, name)
+			}
+			st.channels = append(st.channels, n-1)
+		}
+		if len(st.channels) > 2 {
+			return nil, fmt.Errorf("stem %s has %d channels, at most 2 are supported", name, len(st.channels))
+		}
+		stems = append(stems, st)
+	}
+	return stems, nil
+}
+
+func stemChannels(stems []stem) int {
+	n := 0
+	for _, s := range stems {
+		for _, c := range s.channels {
+			n = max(n, c+1)
+		}
+	}
+	return n
+}
+
+// stemPCMFormat is the format a multitrack master is decoded to, checked
+// against the stem map.
+func stemPCMFormat(ref trackRef, track TrackDownload, stems []stem) (pcmFormat, error) {
+	log := ref.logger()
+	needed := stemChannels(stems)
+	if track.Channels <= 0 {
+		log.Warn("manifest has no channel configuration, assuming the stem map covers every channel", "channels", needed)
+		track.Channels = needed
+	}
+	format := trackPCMFormat(ref, track)
+	if format.channels < needed {
+		return pcmFormat{}, fmt.Errorf("the stem map needs %d channels but the track has %d", needed, format.channels)
+	}
+	mapped := make([]bool, format.channels)
+	for _, s := range stems {
+		for _, c := range s.channels {
+			mapped[c] = true
+		}
+	}
+	for c, ok := range mapped {
+		if !ok {
+			log.Warn("channel is not in the stem map and is dropped", "channel", c+1, "channels", format.channels)
+		}
+	}
+	return format, nil
+}
+
+// splitStems decodes a multichannel track once and writes every stem to its
+// own file, all at the same time.
+func splitStems(ref trackRef, track TrackDownload, opts convertOptions) ([]exportedFile, error) {
+	format, err := stemPCMFormat(ref, track, opts.stems)
+	if err != nil {
+		return nil, err
+	}
+
+	// The writers are made before the decoder starts, which must not be left
+	// running on an early return.
+	writers := make([]pcmWriter, len(opts.stems))
+	for i, s := range opts.stems {
+		if writers[i], err = pcmWriterFor(opts.format, withTags(track.Tags, tag{"STEM", s.name})); err != nil {
+			return nil, err
+		}
+	}
+
+	ref.logger().Debug("splitting stems", "decoder", opts.decoder.Name(), "stems", len(opts.stems), "channels", format.channels)
+
+	pcm, err := opts.decoder.Decode(track.OutputPath, format)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(track.OutputPath)
+	files := make([]exportedFile, len(opts.stems))
+	pipes := make([]*io.PipeWriter, len(opts.stems))
+	errs := make([]error, len(opts.stems))
+	var wg sync.WaitGroup
+
+	for i, s := range opts.stems {
+		files[i] = exportedFile{path: filepath.Join(dir, s.name+"."+opts.format), stem: s.name}
+
+		r, w := io.Pipe()
+		pipes[i] = w
+		wg.Add(1)
+		go func(i int, s stem) {
+			defer wg.Done()
+			errs[i] = writers[i](files[i].path, pcmFormat{sampleRate: format.sampleRate, channels: len(s.channels)}, r)
+			r.CloseWithError(errs[i])
+		}(i, s)
+	}
+
+	err = demuxStems(trimPCM(pcm, format, track.Duration), format, opts.stems, pipes)
+	for _, w := range pipes {
+		w.CloseWithError(err)
+	}
+	wg.Wait()
+
+	if closeErr := pcm.Close(); err == nil {
+		err = closeErr
+	}
+	for i, e := range errs {
+		if e != nil && err == nil {
+			err = fmt.Errorf("stem %s: %v", opts.stems[i].name, e)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// demuxStems copies the channels of each stem out of interleaved PCM.
+func demuxStems(pcm io.Reader, format pcmFormat, stems []stem, outs []*io.PipeWriter) error {
+	const bytesPerSample = pcmBitsPerSample / 8
+	frameSize := format.frameSize()
+	buf := make([]byte, 4096*frameSize)
+	stemBufs := make([][]byte, len(stems))
+
+	for {
+		n, err := io.ReadFull(pcm, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n%frameSize != 0 {
+			return fmt.Errorf("decoder returned a partial frame of %d bytes", n%frameSize)
+		}
+
+		frames := n / frameSize
+		for i, s := range stems {
+			out := stemBufs[i][:0]
+			for f := 0; f < frames; f++ {
+				frame := buf[f*frameSize:]
+				for _, c := range s.channels {
+					out = append(out, frame[c*bytesPerSample:(c+1)*bytesPerSample]...)
+				}
+			}
+			stemBufs[i] = out
+			if _, err := outs[i].Write(out); err != nil {
+				return err
+			}
+		}
+
+		if err == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"blurlconvert/bmff"
+)
+
+// tagVendor names the writer in Vorbis comment headers.
+const tagVendor = "blurlconvert"
+
+// tag is one metadata field of an output. Keys are Vorbis comment field
+// names; MP4 writes the ones iTunes has an item for as that item and the rest
+// as freeform items.
+type tag struct {
+	key   string
+	value string
+}
+
+// Provenance tags, which let a library match a converted file back to the
+// blurl it came from.
+const (
+	tagSource   = "BLURL_SOURCE"
+	tagAssetID  = "BLURL_ASSET_ID"
+	tagType     = "BLURL_PLAYLIST_TYPE"
+	tagDuration = "BLURL_DURATION"
+)
+
+// mp4TagItems are the ilst items iTunes defines for Vorbis comment fields.
+var mp4TagItems = map[string]string{
+	"TITLE":   "\xa9nam",
+	"ARTIST":  "\xa9ART",
+	"ALBUM":   "\xa9alb",
+	"DATE":    "\xa9day",
+	"GENRE":   "\xa9gen",
+	"COMMENT": "\xa9cmt",
+	"ENCODER": "\xa9too",
+}
+
+// sourceTags describes where the outputs of a playlist come from. duration is
+// the length of the song in seconds, not of a clip cut from it.
+func sourceTags(input string, playlist Playlist, assetID string, duration float64) []tag {
+	typ := playlistMain
+	if playlist.isPreview() {
+		typ = playlistPreview
+	}
+	tags := []tag{
+		{"TITLE", inputName(input)},
+		{"LANGUAGE", playlist.Language},
+		{tagSource, filepath.Base(input)},
+		{tagAssetID, assetID},
+		{tagType, typ},
+		{tagDuration, strconv.FormatFloat(duration, 'f', 3, 64)},
+	}
+
+	var out []tag
+	for _, t := range tags {
+		if t.value != "" {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// parseTag reads a --tag flag, KEY=value. Keys follow the rules of Vorbis
+// comment field names and are stored upper case.
+func parseTag(s string) (tag, error) {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return tag{}, fmt.Errorf("invalid tag %q, expected KEY=value", s)
+	}
+	for _, r := range key {
+		if r < 0x20 || r > 0x7d {
+			return tag{}, fmt.Errorf("invalid tag name %q, only ASCII letters, digits and punctuation are allowed", key)
+		}
+	}
+	return tag{key: strings.ToUpper(key), value: value}, nil
+}
+
+// withTags returns base with extra added. A key of extra replaces every value
+// base has for it, so --tag TITLE=... overrides the default title.
+func withTags(base []tag, extra ...tag) []tag {
+	var out []tag
+	for _, t := range base {
+		replaced := false
+		for _, e := range extra {
+			if e.key == t.key {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out = append(out, t)
+		}
+	}
+	return append(out, extra...)
+}
+
+// vorbisComments is the comment header shared by Ogg formats and FLAC
+// (https://xiph.org/vorbis/doc/v-comment.html), without a framing bit.
+func vorbisComments(tags []tag) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(tagVendor)))
+	b = append(b, tagVendor...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(tags)))
+	for _, t := range tags {
+		c := t.key + "=" + t.value
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(c)))
+		b = append(b, c...)
+	}
+	return b
+}
+
+// udtaBox holds tags the way iTunes writes them: an ilst in a meta box with
+// an mdir handler. Every value is UTF-8 text.
+func udtaBox(tags []tag) []byte {
+	var items [][]byte
+	for _, t := range tags {
+		// Type 1 is UTF-8, followed by a locale of 0.
+		data := bmff.EncodeFull("data", 0, 1, make([]byte, 4), []byte(t.value))
+		if item, ok := mp4TagItems[t.key]; ok {
+			items = append(items, bmff.Encode(item, data))
+			continue
+		}
+		items = append(items, bmff.Encode("----",
+			bmff.EncodeFull("mean", 0, 0, []byte("com.apple.iTunes")),
+			bmff.EncodeFull("name", 0, 0, []byte(t.key)),
+			data))
+	}
+
+	hdlr := make([]byte, 4, 25)
+	hdlr = append(hdlr, "mdirappl"...)
+	hdlr = append(hdlr, make([]byte, 9)...)
+	return bmff.Encode("udta", bmff.EncodeFull("meta", 0, 0, bmff.EncodeFull("hdlr", 0, 0, hdlr), bmff.Encode("ilst", items...)))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"blurlconvert/bmff"
+)
+
+type segmentInfo struct {
+	hasTfdt bool
+	tfdt    uint64
+}
+
+func validateSegment(buf []byte, expectedSize int64) (segmentInfo, error) {
+	var info segmentInfo
+
+	if expectedSize > 0 && int64(len(buf)) != expectedSize {
+		return info, fmt.Errorf("%w: got %d bytes, expected %d", errIntegrity, len(buf), expectedSize)
+	}
+
+	boxes, err := bmff.Parse(buf)
+	if err != nil {
+		return info, fmt.Errorf("%w: %v", errIntegrity, err)
+	}
+
+	sawMoof := false
+	sawMdat := false
+	for i, b := range boxes {
+		switch b.Type {
+		case "styp":
+			if i != 0 {
+				return info, fmt.Errorf("%w: styp is not the first box", errIntegrity)
+			}
+		case "sidx", "ssix", "prft", "emsg", "free", "skip":
+		case "moof":
+			if sawMoof && !sawMdat {
+				return info, fmt.Errorf("%w: moof without mdat", errIntegrity)
+			}
+			if !sawMoof {
+				if box, ok := b.Find("traf", "tfdt"); ok {
+					tfdt, err := bmff.ParseTfdt(box)
+					if err != nil {
+						return info, fmt.Errorf("%w: %v", errIntegrity, err)
+					}
+					info.tfdt = tfdt.BaseMediaDecodeTime
+					info.hasTfdt = true
+				}
+			}
+			sawMoof = true
+			sawMdat = false
+		case "mdat":
+			if !sawMoof {
+				return info, fmt.Errorf("%w: mdat before moof", errIntegrity)
+			}
+			sawMdat = true
+		default:
+			return info, fmt.Errorf("%w: unexpected %q box in segment", errIntegrity, b.Type)
+		}
+	}
+
+	if !sawMoof || !sawMdat {
+		return info, fmt.Errorf("%w: segment has no moof+mdat", errIntegrity)
+	}
+
+	return info, nil
+}
+
+func validateSegmentFile(path string, expectedSize int64) (segmentInfo, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return segmentInfo{}, err
+	}
+	return validateSegment(buf, expectedSize)
+}
+
+// validateInitFile checks that an init segment holds a moov. Only box
+// headers are read, so the media data of a whole file is never loaded.
+func validateInitFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bmff.NewReader(f)
+	for {
+		h, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: init segment has no moov", errIntegrity)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errIntegrity, err)
+		}
+		if h.Type == "moov" {
+			return nil
+		}
+	}
+}
+
+type tfdtSequence struct {
+	last uint64
+	seen bool
+}
+
+func (s *tfdtSequence) check(segNumber int, info segmentInfo) error {
+	if !info.hasTfdt {
+		return nil
+	}
+	if s.seen && info.tfdt <= s.last {
+		return fmt.Errorf("segment %d: tfdt %d does not follow previous %d", segNumber, info.tfdt, s.last)
+	}
+	s.last = info.tfdt
+	s.seen = true
+	return nil
+}
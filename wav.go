@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatExtensible = 0xfffe
+)
+
+// wavHeader is the RIFF header for dataSize bytes of PCM. More than two
+// channels need WAVE_FORMAT_EXTENSIBLE; the channel mask is left unset because
+// the channels are not speaker positions.
+func wavHeader(format pcmFormat, dataSize uint32) []byte {
+	fmtSize := 16
+	if format.channels > 2 {
+		fmtSize = 40
+	}
+
+	b := make([]byte, 0, 28+fmtSize+8)
+	b = append(b, "RIFF"...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(4+8+fmtSize+8)+dataSize)
+	b = append(b, "WAVE"...)
+
+	b = append(b, "fmt "...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(fmtSize))
+	tag := uint16(wavFormatPCM)
+	if format.channels > 2 {
+		tag = wavFormatExtensible
+	}
+	b = binary.LittleEndian.AppendUint16(b, tag)
+	b = binary.LittleEndian.AppendUint16(b, uint16(format.channels))
+	b = binary.LittleEndian.AppendUint32(b, uint32(format.sampleRate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(format.sampleRate*format.frameSize()))
+	b = binary.LittleEndian.AppendUint16(b, uint16(format.frameSize()))
+	b = binary.LittleEndian.AppendUint16(b, pcmBitsPerSample)
+	if format.channels > 2 {
+		b = binary.LittleEndian.AppendUint16(b, 22)
+		b = binary.LittleEndian.AppendUint16(b, pcmBitsPerSample)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		// KSDATAFORMAT_SUBTYPE_PCM
+		b = append(b, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xaa, 0x00, 0x38, 0x9b, 0x71)
+	}
+
+	b = append(b, "data"...)
+	b = binary.LittleEndian.AppendUint32(b, dataSize)
+	return b
+}
+
+// writeWAV copies PCM into a WAV file. The sizes in the header are only known
+// at the end, so they are patched in once all samples are written.
+func writeWAV(dst string, format pcmFormat, pcm io.Reader) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	header := wavHeader(format, 0)
+	if _, err := f.Write(header); err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	n, err := io.Copy(w, pcm)
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if n%int64(format.frameSize()) != 0 {
+		return fmt.Errorf("decoder returned %d bytes, not a whole number of %d-byte frames", n, format.frameSize())
+	}
+	if n+int64(len(header)) > math.MaxUint32 {
+		return fmt.Errorf("%d bytes of audio do not fit in a WAV file", n)
+	}
+
+	if _, err := f.WriteAt(wavHeader(format, uint32(n)), 0); err != nil {
+		return err
+	}
+	return f.Close()
+}
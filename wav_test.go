@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteWAV(t *testing.T) {
+	tests := []struct {
+		channels int
+		tag      uint16
+		fmtSize  uint32
+	}{
+		{2, wavFormatPCM, 16},
+		{6, wavFormatExtensible, 40},
+	}
+	for _, tt := range tests {
+		format := pcmFormat{sampleRate: 44100, channels: tt.channels}
+		pcm := flacTestPCM(1000, tt.channels)
+
+		dst := filepath.Join(t.TempDir(), "out.wav")
+		if err := writeWAV(dst, format, bytes.NewReader(pcm)); err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		le := binary.LittleEndian
+		if string(b[0:4]) != "RIFF" || string(b[8:16]) != "WAVEfmt " {
+			t.Fatalf("%d channels: bad RIFF header % x", tt.channels, b[:16])
+		}
+		if size := le.Uint32(b[4:8]); int(size) != len(b)-8 {
+			t.Errorf("%d channels: RIFF size %d, file has %d bytes after it", tt.channels, size, len(b)-8)
+		}
+		fmtSize := le.Uint32(b[16:20])
+		if fmtSize != tt.fmtSize || le.Uint16(b[20:22]) != tt.tag {
+			t.Errorf("%d channels: fmt chunk of %d bytes with format %#x", tt.channels, fmtSize, le.Uint16(b[20:22]))
+		}
+		if ch, rate, align, bits := le.Uint16(b[22:24]), le.Uint32(b[24:28]), le.Uint16(b[32:34]), le.Uint16(b[34:36]); int(ch) != tt.channels || rate != 44100 || int(align) != 2*tt.channels || bits != 16 {
+			t.Errorf("%d channels: fmt says %d channels at %d Hz, %d-byte frames of %d bits", tt.channels, ch, rate, align, bits)
+		}
+		if byteRate := le.Uint32(b[28:32]); byteRate != uint32(44100*2*tt.channels) {
+			t.Errorf("%d channels: byte rate %d", tt.channels, byteRate)
+		}
+
+		data := b[20+fmtSize:]
+		if string(data[0:4]) != "data" || int(le.Uint32(data[4:8])) != len(pcm) {
+			t.Fatalf("%d channels: data chunk header % x", tt.channels, data[:8])
+		}
+		if !bytes.Equal(data[8:], pcm) {
+			t.Errorf("%d channels: data differs from the input", tt.channels)
+		}
+	}
+}
+
+func TestWriteWAVPartialFrame(t *testing.T) {
+	dst := filepath.Join(t.TempDir(), "out.wav")
+	if err := writeWAV(dst, pcmFormat{sampleRate: 48000, channels: 2}, bytes.NewReader(make([]byte, 7))); err == nil {
+		t.Fatal("a partial frame was accepted")
+	}
+}